@@ -0,0 +1,136 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A master's RPC endpoints, net/rpc and the JSON API alike, may be
+// locked down in two ways. With -tlscert, -tlskey and -tlsca the master
+// serves over TLS and takes calls only from clients presenting a
+// certificate signed by the CA, while slaves present their own
+// certificate and check the master's against the same CA. With
+// -rpctoken every caller must also send the shared secret held in the
+// named file. Masters check callers with rpcAuth; clients set up their
+// connections with clientTLS and rpcSecret. The pages that change or
+// list links, rather than add them, are served only with -admin, and
+// check callers the same way.
+
+var (
+	clientTLS *tls.Config // for calling masters, if they use TLS
+	rpcSecret string      // sent with RPC calls and required of callers, if set
+	needCert  bool        // whether callers must present a verified certificate
+)
+
+var errNoCert = errors.New("no verified client certificate")
+
+// setupAuth loads the certificates and secret named by the flags. It
+// returns the TLS configuration a master should serve with, or nil if
+// it should not use TLS.
+func setupAuth(certFile, keyFile, caFile, tokenFile string) (*tls.Config, error) {
+	if tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		rpcSecret = strings.TrimSpace(string(b))
+		if rpcSecret == "" {
+			return nil, fmt.Errorf("%s: empty token", tokenFile)
+		}
+	}
+	if certFile == "" && caFile == "" {
+		return nil, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("-tlscert and -tlskey go together")
+	}
+	server := &tls.Config{MinVersion: tls.VersionTLS12}
+	clientTLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.Certificates = []tls.Certificate{cert}
+		clientTLS.Certificates = server.Certificates
+	}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no certificates", caFile)
+		}
+		clientTLS.RootCAs = pool
+		// Browsers still reach the redirects without a certificate;
+		// rpcAuth insists on one for RPC.
+		server.ClientCAs = pool
+		server.ClientAuth = tls.VerifyClientCertIfGiven
+		needCert = true
+	}
+	if server.Certificates == nil {
+		return nil, nil
+	}
+	return server, nil
+}
+
+// rpcAuth admits callers to h only if they pass checkCaller, refusing
+// and logging the rest.
+func rpcAuth(h http.Handler) http.Handler {
+	if !needCert && rpcSecret == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkCaller(r); err != nil {
+			log.Printf("rpc: refused %s %s: %v", r.RemoteAddr, r.URL.Path, err)
+			statSend("rpc refused")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func checkCaller(r *http.Request) error {
+	if needCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return errNoCert
+	}
+	if rpcSecret != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(rpcSecret)) != 1 {
+			return errors.New("wrong or missing token")
+		}
+	}
+	return nil
+}
+
+// authHeader returns the header line a client sends to authenticate.
+func authHeader() string {
+	if rpcSecret == "" {
+		return ""
+	}
+	return "Authorization: Bearer " + rpcSecret + "\r\n"
+}
@@ -0,0 +1,144 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// A keyFilter blocks keys that must not be used, such as generated
+// keys that happen to spell something offensive. Its rules are read
+// from a file with one rule per line:
+//
+//	# comments and blank lines are ignored
+//	word badword        block this key exactly
+//	substring bad       block any key containing this
+//	regexp ^x{3,}$      block any key matching this
+//
+// A line with no kind is a word. Words and substrings are matched
+// without regard to case.
+type keyFilter struct {
+	rules  []string // as read, so they can be passed on to slaves
+	words  map[string]bool
+	subs   []string
+	regexp []*regexp.Regexp
+}
+
+var errBlocked = errors.New("key is blocked")
+
+// curBlocklist holds the *keyFilter in effect. Slaves use their
+// master's, adopting it each time they connect.
+var curBlocklist atomic.Value
+
+func init() {
+	curBlocklist.Store(new(keyFilter))
+}
+
+// blocklist returns the rules in effect.
+func blocklist() *keyFilter {
+	return curBlocklist.Load().(*keyFilter)
+}
+
+func setBlocklist(kf *keyFilter) {
+	curBlocklist.Store(kf)
+}
+
+func loadKeyFilter(filename string) (*keyFilter, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		rules = append(rules, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return parseKeyFilter(rules)
+}
+
+func parseKeyFilter(rules []string) (*keyFilter, error) {
+	kf := &keyFilter{rules: rules, words: make(map[string]bool)}
+	for i, line := range rules {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kind, pat := "word", line
+		if f := strings.SplitN(line, " ", 2); len(f) == 2 {
+			kind, pat = f[0], strings.TrimSpace(f[1])
+		}
+		switch kind {
+		case "word":
+			kf.words[strings.ToLower(pat)] = true
+		case "substring":
+			kf.subs = append(kf.subs, strings.ToLower(pat))
+		case "regexp":
+			re, err := regexp.Compile(pat)
+			if err != nil {
+				return nil, fmt.Errorf("blocklist line %d: %v", i+1, err)
+			}
+			kf.regexp = append(kf.regexp, re)
+		default:
+			return nil, fmt.Errorf("blocklist line %d: unknown rule %q", i+1, kind)
+		}
+	}
+	return kf, nil
+}
+
+func (kf *keyFilter) blocks(key string) bool {
+	lower := strings.ToLower(key)
+	if kf.words[lower] {
+		return true
+	}
+	for _, s := range kf.subs {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	for _, re := range kf.regexp {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyAllowed reports whether key may be used at all: it must be neither
+// reserved nor blocked.
+func keyAllowed(key string) bool {
+	return !reservedKeys[key] && !blocklist().blocks(key)
+}
+
+// KeyRules describes how a store makes and filters keys, so that its
+// slaves can do the same.
+type KeyRules struct {
+	Alphabet  string
+	Blocklist []string
+}
+
+func (s *URLStore) KeyRules(_ *int, r *KeyRules) error {
+	*r = KeyRules{Alphabet: alphabet(), Blocklist: blocklist().rules}
+	return nil
+}
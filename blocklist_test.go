@@ -0,0 +1,72 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import "testing"
+
+func TestKeyFilter(t *testing.T) {
+	rules := []string{
+		"# a comment, then a blank line",
+		"",
+		"word BadWord",
+		"plain",
+		"  substring Rude  ",
+		"regexp ^x{3,}$",
+	}
+	kf, err := parseKeyFilter(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key     string
+		blocked bool
+	}{
+		{"badword", true},
+		{"BADWORD", true},
+		{"badwords", false},
+		{"plain", true},
+		{"Plain", true},
+		{"rude", true},
+		{"veryRUDEkey", true},
+		{"rud", false},
+		{"xxx", true},
+		{"xxxxxx", true},
+		{"xx", false},
+		{"XXX", false},
+		{"a", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := kf.blocks(tt.key); got != tt.blocked {
+			t.Errorf("blocks(%q) = %v, want %v", tt.key, got, tt.blocked)
+		}
+	}
+}
+
+func TestKeyFilterErrors(t *testing.T) {
+	tests := []struct {
+		rules []string
+		err   string
+	}{
+		{[]string{"word a", "prefix b"}, `blocklist line 2: unknown rule "prefix"`},
+		{[]string{"regexp (unclosed"}, "blocklist line 1: error parsing regexp: missing closing ): `(unclosed`"},
+	}
+	for _, tt := range tests {
+		_, err := parseKeyFilter(tt.rules)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("parseKeyFilter(%q) error = %v, want %s", tt.rules, err, tt.err)
+		}
+	}
+}
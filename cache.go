@@ -0,0 +1,319 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	entryOverhead = 200 // approximate bytes an entry uses beyond its key and URL
+	missKept      = 2e9 // how long to remember that the master has no such key
+)
+
+// errNotCached means the cache knows nothing about a key.
+var errNotCached = errors.New("link not cached")
+
+// linkCache is a ProxyStore's cache of the master's links. It holds at
+// most maxLen links and about maxBytes bytes, evicting the least
+// recently used links to make room, and if ttl is set it forgets links
+// after that long so they are fetched from the master again. It also
+// remembers for a short while which keys the master does not have.
+//
+// Pinned links are neither evicted nor forgotten. A slave pins the
+// links it has made from a lease until the master has a copy.
+type linkCache struct {
+	mu       sync.Mutex
+	maxLen   int // 0 for no limit
+	maxBytes int // 0 for no limit
+	ttl      time.Duration
+	size     int
+	lru      *list.List // unpinned entries, most recently used first
+	entries  map[string]*cacheEntry
+	byURL    map[string]string // nil unless deduplicating
+	hits     uint64
+	misses   uint64
+}
+
+type cacheEntry struct {
+	key   string
+	link  Link
+	added time.Time
+	elem  *list.Element // nil while pinned
+	miss  bool          // the master has no such key
+}
+
+func newLinkCache(maxLen, maxBytes int, ttl time.Duration) *linkCache {
+	c := &linkCache{
+		maxLen:   maxLen,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*cacheEntry),
+	}
+	if *dedup {
+		c.byURL = make(map[string]string)
+	}
+	return c
+}
+
+// get returns the cached link for key, or errNotCached if there is
+// none. Like URLStore.GetLink, it returns errExpired for a link past
+// its expiry time, and errNotFound for a key the master lacks.
+func (c *linkCache) get(key string) (Link, error) {
+	var stats []string // sent once c.mu is released
+	defer func() {
+		for _, s := range stats {
+			statSend(s)
+		}
+	}()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok && e.miss && time.Since(e.added) > missKept {
+		c.remove(e)
+		ok = false
+	}
+	if ok && e.elem != nil && c.ttl > 0 && time.Since(e.added) > c.ttl {
+		c.remove(e)
+		stats = append(stats, "cache stale")
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		stats = append(stats, "cache miss")
+		return Link{}, errNotCached
+	}
+	c.hits++
+	stats = append(stats, "cache hit")
+	if e.elem != nil {
+		c.lru.MoveToFront(e.elem)
+	}
+	if e.miss {
+		return Link{}, errNotFound
+	}
+	if !e.link.Expires.IsZero() && !time.Now().Before(e.link.Expires) {
+		return Link{}, errExpired
+	}
+	return e.link, nil
+}
+
+// add caches key as pointing at l, replacing any earlier value.
+func (c *linkCache) add(key string, l Link) {
+	c.mu.Lock()
+	c.insert(key, l, false)
+	n := c.evict()
+	c.mu.Unlock()
+	statEvicted(n)
+}
+
+// miss records that the master has no link for key.
+func (c *linkCache) miss(key string) {
+	var n int
+	c.mu.Lock()
+	if _, ok := c.entries[key]; !ok {
+		c.insert(key, Link{}, false)
+		c.entries[key].miss = true
+		n = c.evict()
+	}
+	c.mu.Unlock()
+	statEvicted(n)
+}
+
+// pin caches key as pointing at l until unpin is called.
+func (c *linkCache) pin(key string, l Link) {
+	c.mu.Lock()
+	c.insert(key, l, true)
+	n := c.evict()
+	c.mu.Unlock()
+	statEvicted(n)
+}
+
+// unpin lets key be evicted again.
+func (c *linkCache) unpin(key string) {
+	var n int
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && e.elem == nil {
+		e.added = time.Now()
+		e.elem = c.lru.PushFront(e)
+		n = c.evict()
+	}
+	c.mu.Unlock()
+	statEvicted(n)
+}
+
+// lookup returns the cached key in namespace ns pointing at url, if
+// the cache is deduplicating and has one that does not expire.
+func (c *linkCache) lookup(ns, url string) (key string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok = c.byURL[indexKey(ns, url)]
+	if ok {
+		if e := c.entries[key]; e.elem != nil {
+			c.lru.MoveToFront(e.elem)
+		}
+	}
+	return
+}
+
+// drop removes key from the cache.
+func (c *linkCache) drop(key string) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+}
+
+// clear empties the cache of all but pinned links.
+func (c *linkCache) clear() {
+	c.mu.Lock()
+	for el := c.lru.Front(); el != nil; el = c.lru.Front() {
+		c.remove(el.Value.(*cacheEntry))
+	}
+	c.mu.Unlock()
+}
+
+// Len returns the number of links cached.
+func (c *linkCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Size returns the approximate memory used by the cache, in bytes.
+func (c *linkCache) Size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Hits returns the number of lookups answered from the cache, and the
+// number that were not.
+func (c *linkCache) Hits() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// insert adds an entry for key. The caller must hold c.mu.
+func (c *linkCache) insert(key string, l Link, pinned bool) {
+	if e, ok := c.entries[key]; ok {
+		pinned = pinned || e.elem == nil
+		c.remove(e)
+	}
+	e := &cacheEntry{key: key, link: l, added: time.Now()}
+	if !pinned {
+		e.elem = c.lru.PushFront(e)
+	}
+	c.entries[key] = e
+	c.size += entrySize(e)
+	if c.byURL != nil && l.URL != "" && l.Expires.IsZero() {
+		ns, _ := splitKey(key)
+		u := indexKey(ns, l.URL)
+		if _, ok := c.byURL[u]; !ok {
+			c.byURL[u] = key
+			c.size += len(u) + len(key)
+		}
+	}
+}
+
+// remove deletes e from the cache. The caller must hold c.mu.
+func (c *linkCache) remove(e *cacheEntry) {
+	if e.elem != nil {
+		c.lru.Remove(e.elem)
+	}
+	delete(c.entries, e.key)
+	c.size -= entrySize(e)
+	if c.byURL != nil && e.link.URL != "" {
+		ns, _ := splitKey(e.key)
+		u := indexKey(ns, e.link.URL)
+		if c.byURL[u] == e.key {
+			delete(c.byURL, u)
+			c.size -= len(u) + len(e.key)
+		}
+	}
+}
+
+// evict removes the least recently used links until the cache is
+// within its limits, and returns how many it removed. The caller must
+// hold c.mu.
+func (c *linkCache) evict() (n int) {
+	for c.lru.Len() > 0 && c.full() {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+		n++
+	}
+	return n
+}
+
+// statEvicted reports n evictions, once the cache lock is released.
+func statEvicted(n int) {
+	for ; n > 0; n-- {
+		statSend("cache evict")
+	}
+}
+
+// full reports whether the cache is over either of its limits. The
+// caller must hold c.mu.
+func (c *linkCache) full() bool {
+	return c.maxLen > 0 && len(c.entries) > c.maxLen ||
+		c.maxBytes > 0 && c.size > c.maxBytes
+}
+
+func entrySize(e *cacheEntry) int {
+	return len(e.key) + len(e.link.URL) + entryOverhead
+}
+
+// fetchGroup lets concurrent callers fetching the same key from the
+// master share one call.
+type fetchGroup struct {
+	mu    sync.Mutex
+	calls map[string]*fetchCall
+}
+
+type fetchCall struct {
+	done chan bool
+	link Link
+	err  error
+}
+
+// do calls fn to fetch key and returns its result, unless a fetch of
+// key is already in progress, in which case it waits for that one and
+// returns its result instead.
+func (g *fetchGroup) do(key string, fn func() (Link, error)) (Link, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*fetchCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		statSend("cache fetch shared")
+		<-c.done
+		return c.link, c.err
+	}
+	c := &fetchCall{done: make(chan bool)}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.link, c.err = fn()
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+	return c.link, c.err
+}
@@ -0,0 +1,182 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func link(url string) Link { return Link{URL: url} }
+
+func TestLinkCache(t *testing.T) {
+	one := entrySize(&cacheEntry{key: "a", link: link("http://a/")})
+	tests := []struct {
+		name     string
+		maxLen   int
+		maxBytes int
+		ttl      time.Duration
+		dedup    bool
+		ops      func(c *linkCache)
+		cached   []string
+		gone     []string
+	}{
+		{
+			name:   "least recently used goes first",
+			maxLen: 2,
+			ops: func(c *linkCache) {
+				c.add("a", link("http://a/"))
+				c.add("b", link("http://b/"))
+				c.get("a")
+				c.add("c", link("http://c/"))
+			},
+			cached: []string{"a", "c"},
+			gone:   []string{"b"},
+		},
+		{
+			name:     "byte limit",
+			maxBytes: 2*one + one/2,
+			ops: func(c *linkCache) {
+				c.add("a", link("http://a/"))
+				c.add("b", link("http://b/"))
+				c.add("c", link("http://c/"))
+			},
+			cached: []string{"b", "c"},
+			gone:   []string{"a"},
+		},
+		{
+			name:   "pinned links count but stay",
+			maxLen: 1,
+			ops: func(c *linkCache) {
+				c.pin("a", link("http://a/"))
+				c.add("b", link("http://b/"))
+			},
+			cached: []string{"a"},
+			gone:   []string{"b"},
+		},
+		{
+			name:   "unpinned links can go",
+			maxLen: 1,
+			ops: func(c *linkCache) {
+				c.pin("a", link("http://a/"))
+				c.unpin("a")
+				c.add("b", link("http://b/"))
+			},
+			cached: []string{"b"},
+			gone:   []string{"a"},
+		},
+		{
+			name: "pinned links survive clear",
+			ops: func(c *linkCache) {
+				c.pin("a", link("http://a/"))
+				c.add("b", link("http://b/"))
+				c.miss("c")
+				c.clear()
+			},
+			cached: []string{"a"},
+			gone:   []string{"b", "c"},
+		},
+		{
+			name: "pinned links survive the ttl",
+			ttl:  time.Nanosecond,
+			ops: func(c *linkCache) {
+				c.pin("a", link("http://a/"))
+				c.add("b", link("http://b/"))
+				time.Sleep(time.Millisecond)
+			},
+			cached: []string{"a"},
+			gone:   []string{"b"},
+		},
+		{
+			name: "replacing a link",
+			ops: func(c *linkCache) {
+				c.add("a", link("http://a/"))
+				c.add("a", link("http://b/"))
+				c.pin("b", link("http://b/"))
+				c.add("b", link("http://c/"))
+			},
+			cached: []string{"a", "b"},
+		},
+		{
+			name:  "reverse index",
+			dedup: true,
+			ops: func(c *linkCache) {
+				c.add("a", link("http://x/"))
+				c.add("b", link("http://x/"))
+				c.add("c", Link{URL: "http://y/", Expires: time.Now().Add(time.Hour)})
+				c.add("ns/d", link("http://x/"))
+				c.drop("a")
+			},
+			cached: []string{"b", "c", "ns/d"},
+			gone:   []string{"a"},
+		},
+		{
+			name:   "reverse index under eviction",
+			maxLen: 1,
+			dedup:  true,
+			ops: func(c *linkCache) {
+				c.add("a", link("http://x/"))
+				c.add("b", link("http://y/"))
+			},
+			cached: []string{"b"},
+			gone:   []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		c := newLinkCache(tt.maxLen, tt.maxBytes, tt.ttl)
+		if tt.dedup {
+			c.byURL = make(map[string]string)
+		}
+		tt.ops(c)
+		checkCacheSize(t, tt.name, c)
+		for _, k := range tt.cached {
+			if _, err := c.get(k); err == errNotCached {
+				t.Errorf("%s: %q not cached", tt.name, k)
+			}
+		}
+		for _, k := range tt.gone {
+			if _, err := c.get(k); err != errNotCached {
+				t.Errorf("%s: %q still cached: %v", tt.name, k, err)
+			}
+		}
+		checkCacheSize(t, tt.name, c)
+		for u, k := range c.byURL {
+			ns, _ := splitKey(k)
+			if e, ok := c.entries[k]; !ok || !e.link.Expires.IsZero() || indexKey(ns, e.link.URL) != u {
+				t.Errorf("%s: reverse index has %q for %q", tt.name, k, u)
+			}
+		}
+		for k := range c.entries {
+			c.drop(k)
+		}
+		if c.size != 0 || c.lru.Len() != 0 || len(c.byURL) != 0 {
+			t.Errorf("%s: emptied cache has size %d, %d in LRU list, %d in reverse index", tt.name, c.size, c.lru.Len(), len(c.byURL))
+		}
+	}
+}
+
+// checkCacheSize checks c.size against the entries and reverse index.
+func checkCacheSize(t *testing.T, name string, c *linkCache) {
+	want := 0
+	for _, e := range c.entries {
+		want += entrySize(e)
+	}
+	for u, k := range c.byURL {
+		want += len(u) + len(k)
+	}
+	if c.size != want {
+		t.Errorf("%s: size %d, want %d", name, c.size, want)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout = 5e9
+	callTimeout = 10e9
+	minBackoff  = 100e6 // first retry delay after the master fails
+	maxBackoff  = 30e9
+)
+
+var (
+	errUnavailable = errors.New("master unavailable")
+	errCallTimeout = errors.New("master call timed out")
+)
+
+// masterClient is an RPC client for the master that dials on first
+// use and redials after the connection breaks. After a failure it
+// backs off exponentially, and until the backoff expires calls fail
+// straight away with errUnavailable rather than queueing up behind a
+// master that is down.
+//
+// The master may be a replicated cluster, given as a list of
+// addresses. The client then moves on to the next node when one fails,
+// and to the leader when a node says it is not the leader.
+type masterClient struct {
+	addrs []string
+
+	mu       sync.Mutex
+	addr     string // the node in use
+	client   caller
+	dialing  bool      // a dial is in progress, without c.mu held
+	conns    int       // connections made so far
+	failures int       // consecutive failures
+	retry    time.Time // no calls before this while failing
+	lastErr  error
+	lastOK   time.Time
+	closed   bool
+}
+
+// MasterStatus describes the state of the connection to the master.
+type MasterStatus struct {
+	Addr      string
+	Connected bool
+	Failures  int
+	Retry     time.Time
+	LastError string
+	LastOK    time.Time
+}
+
+func newMasterClient(addr string) *masterClient {
+	addrs := strings.Split(addr, ",")
+	return &masterClient{addrs: addrs, addr: addrs[0]}
+}
+
+// Call invokes the named method on the master, failing if it gets no
+// answer within callTimeout. Errors returned by the method itself
+// leave the connection alone; any other error drops it and is
+// reported as errUnavailable, with the details kept for Status. Calls
+// refused by a node that is not the leader are retried on the leader.
+func (c *masterClient) Call(method string, args, reply interface{}) error {
+	err := c.call(method, args, reply)
+	for tries := 0; tries < 2 && remoteError(err) == errNotLeader; tries++ {
+		var addr string
+		if c.call("Store.Leader", new(int), &addr) != nil || addr == "" {
+			break
+		}
+		c.use(addr)
+		err = c.call(method, args, reply)
+	}
+	return err
+}
+
+func (c *masterClient) call(method string, args, reply interface{}) error {
+	client, err := c.get()
+	if err != nil {
+		return err
+	}
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	t := time.NewTimer(callTimeout)
+	defer t.Stop()
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-t.C:
+		err = errCallTimeout
+	}
+	if _, ok := err.(rpc.ServerError); ok || err == nil {
+		c.succeed()
+	} else {
+		c.fail(client, err)
+		if err != errCallTimeout {
+			err = errUnavailable
+		}
+	}
+	return err
+}
+
+// get returns the current connection, dialing if there is none.
+// Callers that come while another dials fail with errUnavailable
+// rather than wait.
+func (c *masterClient) get() (caller, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errClosed
+	}
+	if c.client != nil {
+		c.mu.Unlock()
+		return c.client, nil
+	}
+	if c.dialing || time.Now().Before(c.retry) {
+		c.mu.Unlock()
+		return nil, errUnavailable
+	}
+	c.dialing = true
+	addr := c.addr
+	c.mu.Unlock()
+
+	client, err := dialMaster(addr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dialing = false
+	if c.closed || addr != c.addr {
+		// Closed, or moved to another node, meanwhile.
+		if err == nil {
+			client.Close()
+		}
+		if c.closed {
+			return nil, errClosed
+		}
+		return nil, errUnavailable
+	}
+	if err != nil {
+		c.failed(err)
+		return nil, errUnavailable
+	}
+	c.client = client
+	c.conns++
+	return client, nil
+}
+
+func (c *masterClient) succeed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		log.Println("ProxyStore: master is back after", c.failures, "failures")
+	}
+	c.failures = 0
+	c.lastOK = time.Now()
+}
+
+// fail drops client, if it is still the current connection, and
+// starts the backoff.
+func (c *masterClient) fail(client caller, err error) {
+	client.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != client {
+		return // someone else noticed first
+	}
+	c.client = nil
+	c.failed(err)
+}
+
+// failed records a failure. The caller must hold c.mu.
+func (c *masterClient) failed(err error) {
+	if c.failures == 0 {
+		log.Println("ProxyStore: lost master:", err)
+	}
+	c.failures++
+	c.lastErr = err
+	if len(c.addrs) > 1 {
+		// Try the next node straight away, backing off only
+		// once all have failed.
+		next := c.addrs[0]
+		for i, a := range c.addrs {
+			if a == c.addr {
+				next = c.addrs[(i+1)%len(c.addrs)]
+			}
+		}
+		c.addr = next
+		if c.failures%len(c.addrs) != 0 {
+			c.retry = time.Time{}
+			return
+		}
+	}
+	rounds := c.failures / len(c.addrs)
+	d := time.Duration(maxBackoff)
+	if rounds < 20 {
+		d = minBackoff << uint(rounds-1)
+		if d > maxBackoff {
+			d = maxBackoff
+		}
+	}
+	c.retry = time.Now().Add(d)
+}
+
+// use switches to the node at addr.
+func (c *masterClient) use(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if addr == c.addr {
+		return
+	}
+	log.Println("ProxyStore: following leader", addr)
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+	c.addr = addr
+}
+
+// generation counts the connections made to the master, so a caller
+// can tell when it may have missed something while disconnected.
+func (c *masterClient) generation() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conns
+}
+
+func (c *masterClient) Status() MasterStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := MasterStatus{
+		Addr:      c.addr,
+		Connected: c.client != nil && c.failures == 0,
+		Failures:  c.failures,
+		LastOK:    c.lastOK,
+	}
+	if c.failures > 0 {
+		st.Retry = c.retry
+	}
+	if c.lastErr != nil {
+		st.LastError = c.lastErr.Error()
+	}
+	return st
+}
+
+// Health reports whether the master is known to be reachable.
+func (c *masterClient) Health() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		return errUnavailable
+	}
+	return nil
+}
+
+func (c *masterClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+// dialHTTP is rpc.DialHTTP with a timeout on connecting and on the
+// HTTP handshake, over TLS and with the token if they are set up.
+func dialHTTP(addr string, timeout time.Duration) (*rpc.Client, error) {
+	var conn net.Conn
+	var err error
+	if clientTLS != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, clientTLS)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\r\n"+authHeader()+"\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial-http", Net: "tcp " + addr, Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Slaves register with their master when they start and then send it a
+// heartbeat every heartbeatEvery, so that the master can show which
+// slaves exist and how they are doing. A slave not heard from for
+// memberDead is shown as dead, and forgotten after memberForget.
+
+const (
+	heartbeatEvery = 5e9
+	memberDead     = 15e9
+	memberForget   = 3600e9
+)
+
+var errNotRegistered = errors.New("slave not registered")
+
+// version names this build. Set it with
+//
+//	go build -ldflags "-X main.version=1.2"
+var version = "devel"
+
+var started = time.Now()
+
+// A Heartbeat is what a slave tells its master about itself.
+type Heartbeat struct {
+	Addr       string // where the slave serves HTTP
+	Version    string
+	Started    time.Time
+	CacheLinks int
+	CacheBytes int
+	Hits       uint64 // lookups answered from the cache
+	Misses     uint64
+}
+
+// A Member is a slave as its master knows it.
+type Member struct {
+	Heartbeat
+	Registered time.Time
+	LastSeen   time.Time
+	Alive      bool
+	HitRatio   float64 // of lookups answered from the cache
+}
+
+// HitPercent returns the hit ratio as a percentage.
+func (m Member) HitPercent() float64 {
+	return m.HitRatio * 100
+}
+
+type members struct {
+	mu sync.Mutex
+	m  map[string]*Member // by address
+}
+
+// Register adds a slave to the master's list of members, or updates
+// its entry if it was already there.
+func (s *URLStore) Register(h *Heartbeat, _ *int) error {
+	t := &s.members
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.m == nil {
+		t.m = make(map[string]*Member)
+	}
+	now := time.Now()
+	log.Printf("URLStore: slave %s registered (version %s)", h.Addr, h.Version)
+	t.m[h.Addr] = &Member{Heartbeat: *h, Registered: now, LastSeen: now}
+	return nil
+}
+
+// Heartbeat records that a registered slave is alive. It fails with
+// errNotRegistered if the master does not know the slave, as after the
+// master restarts, and the slave should then register again.
+func (s *URLStore) Heartbeat(h *Heartbeat, _ *int) error {
+	t := &s.members
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.m[h.Addr]
+	if !ok {
+		return errNotRegistered
+	}
+	if time.Since(m.LastSeen) > memberDead {
+		log.Printf("URLStore: slave %s is back", h.Addr)
+	}
+	m.Heartbeat = *h
+	m.LastSeen = time.Now()
+	return nil
+}
+
+// Members lists the registered slaves by address, forgetting any that
+// have been dead for long enough.
+func (s *URLStore) Members() []Member {
+	t := &s.members
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var list []Member
+	for addr, m := range t.m {
+		age := time.Since(m.LastSeen)
+		if age > memberForget {
+			delete(t.m, addr)
+			continue
+		}
+		mm := *m
+		mm.Alive = age <= memberDead
+		if n := mm.Hits + mm.Misses; n > 0 {
+			mm.HitRatio = float64(mm.Hits) / float64(n)
+		}
+		list = append(list, mm)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
+
+// heartbeatLoop registers the slave with the master m and then sends
+// it heartbeats until the slave closes.
+func (s *ProxyStore) heartbeatLoop(m *masterClient) {
+	method := "Store.Register"
+	var last error
+	for {
+		h := s.heartbeat()
+		err := remoteError(m.Call(method, &h, new(int)))
+		switch err {
+		case nil:
+			method = "Store.Heartbeat"
+		case errClosed:
+			return
+		case errNotRegistered:
+			method = "Store.Register"
+			continue
+		case errUnavailable, errCallTimeout:
+		default:
+			if last == nil || err.Error() != last.Error() {
+				log.Println("ProxyStore: heartbeat:", err)
+			}
+		}
+		last = err
+		time.Sleep(heartbeatEvery)
+	}
+}
+
+func (s *ProxyStore) heartbeat() Heartbeat {
+	h := Heartbeat{
+		Addr:       slaveAddr(),
+		Version:    version,
+		Started:    started,
+		CacheLinks: s.urls.Len(),
+		CacheBytes: s.urls.Size(),
+	}
+	h.Hits, h.Misses = s.urls.Hits()
+	return h
+}
+
+// slaveAddr returns the address a slave gives its master: -self if
+// set, otherwise this machine's name and the -http port. (-host will
+// not do, being the same for all slaves behind a load balancer.)
+func slaveAddr() string {
+	if *selfAddr != "" {
+		return *selfAddr
+	}
+	host, port, err := net.SplitHostPort(*listenAddr)
+	if err != nil || host == "" {
+		host, _ = os.Hostname()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// A ClusterStatus is what /cluster shows: this master and its slaves.
+type ClusterStatus struct {
+	Master  string
+	Version string
+	Members []Member
+}
+
+var clusterPage = template.Must(template.New("cluster").Parse(`<html>
+<head><title>goto cluster</title></head>
+<body>
+<h1>Master {{.Master}}</h1>
+<p>Version {{.Version}}</p>
+<table border="1" cellpadding="4">
+<tr><th>Slave</th><th>Status</th><th>Version</th><th>Cached links</th><th>Cache bytes</th><th>Hit ratio</th><th>Last heartbeat</th><th>Registered</th></tr>
+{{range .Members}}<tr>
+<td><a href="http://{{.Addr}}/health">{{.Addr}}</a></td>
+<td>{{if .Alive}}live{{else}}<b>dead</b>{{end}}</td>
+<td>{{.Version}}</td>
+<td>{{.CacheLinks}}</td>
+<td>{{.CacheBytes}}</td>
+<td>{{printf "%.1f%%" .HitPercent}}</td>
+<td>{{.LastSeen.UTC.Format "2006-01-02T15:04:05Z07:00"}}</td>
+<td>{{.Registered.UTC.Format "2006-01-02T15:04:05Z07:00"}}</td>
+</tr>
+{{else}}<tr><td colspan="8">No slaves have registered.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
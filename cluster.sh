@@ -0,0 +1,121 @@
+#!/bin/sh
+
+# Runs a replicated cluster of 3 goto nodes and 1 slave on this machine,
+# kills the leader to check that another takes over, then restarts it
+# to check that it catches up. The nodes compact their journals often,
+# so the restarted node is sent a snapshot. Last it stops both
+# followers, adds a link that cannot commit, and restarts them to check
+# that every node, the leader too, has the link once it does. Exits
+# non-zero on failure.
+
+PEERS=localhost:8081,localhost:8082,localhost:8083
+SLAVE=127.0.0.1:8080
+DIR=$(mktemp -d)
+failed=0
+
+leader() {
+	curl -s http://localhost:8081/health http://localhost:8082/health http://localhost:8083/health |
+		grep leader: | sort | uniq -c | sort -n | tail -1 | sed 's/.*leader: //'
+}
+
+node() {
+	./goto -peers=$PEERS -http=:808$1 -file=$DIR/node$1.json -compact=20 2>>$DIR/node$1.log &
+	eval node$1_pid=$!
+}
+
+stop() {
+	eval kill \$node$1_pid
+}
+
+add() {
+	key=$(curl -s -d url=$1 http://$SLAVE/add | sed 's|.*/||')
+	if [ -z "$key" ]; then
+		echo "FAIL: could not add $1"
+		failed=1
+	fi
+	echo $key
+}
+
+check() {
+	got=$(curl -s -o /dev/null -w '%{redirect_url}' http://$1/$2)
+	if [ "$got" != "$3" ]; then
+		echo "FAIL: $1/$2 is '$got', want '$3'"
+		failed=1
+	fi
+}
+
+echo "Starting up in $DIR"
+go build -o goto || exit 1
+node 1
+node 2
+node 3
+sleep 2
+./goto -host=$SLAVE -master=$PEERS -http=:8080 2>$DIR/slave.log &
+slave_pid=$!
+sleep 1
+
+old=$(leader)
+echo "Leader is $old; adding links through the slave"
+first=$(add http://golang.org/)
+for i in $(seq 1 30); do
+	add http://golang.org/$i >/dev/null
+done
+
+case $old in
+localhost:8081) kill $node1_pid; n=1 ;;
+localhost:8082) kill $node2_pid; n=2 ;;
+localhost:8083) kill $node3_pid; n=3 ;;
+esac
+sleep 2
+new=$(leader)
+echo "Killed the leader; leader is now $new; adding more links"
+if [ -z "$new" ] || [ "$new" = "$old" ]; then
+	echo "FAIL: no new leader"
+	failed=1
+fi
+for i in $(seq 31 60); do
+	add http://golang.org/$i >/dev/null
+done
+last=$(add http://golang.org/doc/)
+check $SLAVE $first http://golang.org/
+check $SLAVE $last http://golang.org/doc/
+
+echo "Restarting $old"
+node $n
+sleep 3
+check $old $first http://golang.org/
+check $old $last http://golang.org/doc/
+
+lead=$(leader)
+echo "Stopping the followers of $lead; adding a link that cannot commit"
+for i in 1 2 3; do
+	[ localhost:808$i = "$lead" ] || stop $i
+done
+sleep 1
+code=$(curl -s -o /dev/null -w '%{http_code}' -d url=http://golang.org/stranded -d key=stranded http://$lead/add)
+if [ "$code" != 503 ]; then
+	echo "FAIL: adding with no followers gave $code, want 503"
+	failed=1
+fi
+echo "Restarting the followers"
+for i in 1 2 3; do
+	[ localhost:808$i = "$lead" ] || node $i
+done
+sleep 3
+for i in 1 2 3; do
+	check localhost:808$i stranded http://golang.org/stranded
+done
+
+for p in 8081 8082 8083; do
+	curl -s http://localhost:$p/health | grep journal
+done
+
+echo "Shutting down"
+kill $slave_pid $node1_pid $node2_pid $node3_pid 2>/dev/null
+wait
+if [ $failed != 0 ]; then
+	echo "FAILED; logs are in $DIR"
+	exit 1
+fi
+echo "PASS"
+rm -r $DIR
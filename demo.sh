@@ -24,6 +24,7 @@ slave2_pid=$!
 ./goto -stats=$STATS -host=$MASTER -master=$MASTER -http=:8083 &
 slave3_pid=$!
 sleep 1
+echo "The slaves are listed at http://$MASTER/cluster"
 
 echo "Testing the master (n=$N1)"
 go build -o bench/bench ./bench
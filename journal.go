@@ -0,0 +1,259 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The journal is an append-only file of records, one per line. Each line
+// holds a sequence number, the CRC-32 (IEEE) of the JSON-encoded record,
+// and the record itself:
+//
+//	17 5a8e1b3c {"Key":"h","URL":"http://golang.org/"}
+//
+// Lines beginning with '{' are plain records written by older versions
+// and carry neither sequence number nor checksum.
+
+// A syncPolicy says when saveLoop commits the journal to stable
+// storage: after every record, never (leaving it to the OS), or as a
+// group commit at a fixed interval. It implements flag.Value.
+type syncPolicy time.Duration
+
+const (
+	syncAlways syncPolicy = 0
+	syncNone   syncPolicy = -1
+)
+
+func (p *syncPolicy) Set(s string) error {
+	switch s {
+	case "always":
+		*p = syncAlways
+	case "none":
+		*p = syncNone
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("want always, none or a duration")
+		}
+		*p = syncPolicy(d)
+	}
+	return nil
+}
+
+func (p *syncPolicy) String() string {
+	switch *p {
+	case syncAlways:
+		return "always"
+	case syncNone:
+		return "none"
+	}
+	return time.Duration(*p).String()
+}
+
+type journal struct {
+	f   *os.File
+	b   *bufio.Writer
+	seq uint64 // sequence number of the last record written
+}
+
+func openJournal(filename string, seq uint64) (*journal, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{f: f, b: bufio.NewWriter(f), seq: seq}, nil
+}
+
+// append writes r to the journal under the next sequence number.
+func (j *journal) append(r record) error {
+	if err := writeRecord(j.b, j.seq+1, r); err != nil {
+		return err
+	}
+	j.seq++
+	return nil
+}
+
+func (j *journal) flush() error {
+	return j.b.Flush()
+}
+
+// sync flushes the journal and commits it to stable storage.
+func (j *journal) sync() error {
+	if err := j.b.Flush(); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// truncate discards the journal's contents. Sequence numbers carry on
+// from where they were.
+func (j *journal) truncate() error {
+	if err := j.b.Flush(); err != nil {
+		return err
+	}
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) close() error {
+	err := j.sync()
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writeRecord(w io.Writer, seq uint64, r record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%d %08x %s\n", seq, crc32.ChecksumIEEE(b), b)
+	return err
+}
+
+var errBadRecord = errors.New("bad record")
+
+func parseRecord(line []byte) (seq uint64, r record, err error) {
+	if len(line) > 0 && line[0] == '{' {
+		err = json.Unmarshal(line, &r)
+		return
+	}
+	f := bytes.SplitN(line, []byte(" "), 3)
+	if len(f) != 3 {
+		return 0, r, errBadRecord
+	}
+	if seq, err = strconv.ParseUint(string(f[0]), 10, 64); err != nil {
+		return 0, r, errBadRecord
+	}
+	sum, err := strconv.ParseUint(string(f[1]), 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE(f[2]) {
+		return 0, r, errBadRecord
+	}
+	err = json.Unmarshal(f[2], &r)
+	return
+}
+
+// readJournal calls fn for each record in filename and returns the
+// number of records read. If repair is set, a torn final record (one
+// that is incomplete or fails its checksum, as a crash mid-write leaves
+// behind) is truncated from the file; damage anywhere else is an error.
+func readJournal(filename string, repair bool, fn func(seq uint64, r record)) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	b := bufio.NewReader(f)
+	var off int64
+	n := 0
+	for {
+		line, err := b.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		seq, r, perr := parseRecord(bytes.TrimRight(line, "\n"))
+		if perr != nil || line[len(line)-1] != '\n' {
+			if _, err := b.Peek(1); err == io.EOF && repair {
+				return n, truncateJournal(filename, off)
+			}
+			return n, fmt.Errorf("%s: bad record at offset %d", filename, off)
+		}
+		fn(seq, r)
+		off += int64(len(line))
+		n++
+	}
+}
+
+func truncateJournal(filename string, off int64) error {
+	if err := os.Truncate(filename, off); err != nil {
+		return err
+	}
+	log.Printf("URLStore: %s: truncated torn record at offset %d", filename, off)
+	return nil
+}
+
+// writeSnapshot atomically replaces filename with the records rs, each
+// stamped with sequence number seq.
+func writeSnapshot(filename string, seq uint64, rs []record) error {
+	tmp, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(tmp)
+	for _, r := range rs {
+		if err = writeRecord(b, seq, r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = b.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+// syncDir commits a directory's entries, such as a rename, to stable
+// storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func snapshotName(filename string) string {
+	return filename + ".snap"
+}
+
+// oldTailName names the journal a compaction sets aside while it writes
+// the snapshot.
+func oldTailName(filename string) string {
+	return filename + ".old"
+}
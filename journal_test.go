@@ -0,0 +1,142 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func recordLine(seq uint64, r record) string {
+	var b bytes.Buffer
+	if err := writeRecord(&b, seq, r); err != nil {
+		panic(err)
+	}
+	return b.String()
+}
+
+func TestParseRecord(t *testing.T) {
+	good := recordLine(7, record{Key: "a", URL: "http://a/"})
+	line := good[:len(good)-1]
+	tests := []struct {
+		name string
+		line string
+		seq  uint64
+		key  string
+		ok   bool
+	}{
+		{"good", line, 7, "a", true},
+		{"legacy", `{"Key":"b","URL":"http://b/"}`, 0, "b", true},
+		{"bad checksum", "7 00000000" + line[len("7 00000000"):], 0, "", false},
+		{"bad seq", "x" + line[1:], 0, "", false},
+		{"too few fields", "7 00000000", 0, "", false},
+		{"torn", line[:len(line)-3], 0, "", false},
+		{"empty", "", 0, "", false},
+	}
+	for _, tt := range tests {
+		seq, r, err := parseRecord([]byte(tt.line))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && (seq != tt.seq || r.Key != tt.key) {
+			t.Errorf("%s: got seq %d key %q, want %d %q", tt.name, seq, r.Key, tt.seq, tt.key)
+		}
+	}
+}
+
+func TestReadJournalTornTail(t *testing.T) {
+	r1 := recordLine(1, record{Key: "a", URL: "http://a/"})
+	r2 := recordLine(2, record{Key: "b", URL: "http://b/"})
+	r3 := recordLine(3, record{Key: "c", URL: "http://c/"})
+	badSum := "3 00000000" + r3[len("3 00000000"):]
+	tests := []struct {
+		name    string
+		data    string
+		repair  bool
+		n       int    // records read
+		want    string // the file afterwards
+		wantErr bool
+	}{
+		{"clean", r1 + r2, true, 2, r1 + r2, false},
+		{"empty", "", true, 0, "", false},
+		{"torn record", r1 + r2 + r3[:10], true, 2, r1 + r2, false},
+		{"torn newline", r1 + r2 + r3[:len(r3)-1], true, 2, r1 + r2, false},
+		{"bad checksum at end", r1 + r2 + badSum, true, 2, r1 + r2, false},
+		{"torn first record", r1[:5], true, 0, "", false},
+		{"damage in the middle", r1 + badSum + r2, true, 1, r1 + badSum + r2, true},
+		{"torn without repair", r1 + r3[:10], false, 1, r1 + r3[:10], true},
+	}
+	dir, err := os.MkdirTemp("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, tt := range tests {
+		filename := filepath.Join(dir, string('a'+rune(i)))
+		if err := os.WriteFile(filename, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		n, err := readJournal(filename, tt.repair, func(seq uint64, r record) {
+			keys = append(keys, r.Key)
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if n != tt.n || len(keys) != tt.n {
+			t.Errorf("%s: read %d records (%v), want %d", tt.name, n, keys, tt.n)
+		}
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s: file is %q, want %q", tt.name, b, tt.want)
+		}
+	}
+}
+
+func TestJournalAppendThenRead(t *testing.T) {
+	dir, err := os.MkdirTemp("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "data")
+	j, err := openJournal(filename, 41)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := j.append(record{Key: k}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	if _, err := readJournal(filename, false, func(seq uint64, r record) {
+		seqs = append(seqs, seq)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 3 || seqs[0] != 42 || seqs[2] != 44 {
+		t.Errorf("sequence numbers %v, want [42 43 44]", seqs)
+	}
+}
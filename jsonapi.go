@@ -0,0 +1,519 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The JSON API offers the store's operations, those of the Store
+// interface, to clients not written in Go, along with the calls slaves
+// make on their master (see jsonMethods). A method is called by
+// POSTing its argument, encoded as JSON, to jsonPath followed by the
+// method's name, and answers with its reply:
+//
+//	POST /_goto/GetLink
+//	"h"
+//
+//	200 OK
+//	{"URL":"http://golang.org/","Namespace":"",...}
+//
+// A call that fails answers with an error status and a body such as
+//
+//	404 Not Found
+//	{"Error":{"Type":"not_found","Message":"key not found"}}
+//
+// where Type is one of
+//
+//	not_found    the key, namespace or method does not exist, or the
+//	             key has expired (404)
+//	conflict     the key or namespace is already taken, or in use (409)
+//	unavailable  the store cannot answer now; try again later (503)
+//	invalid      the request is malformed or not allowed (400)
+//	internal     anything else (500)
+//
+// The results of GetMulti and PutMulti give the same Type, with the
+// message in Err, for each item that fails:
+//
+//	{"Key":"h","Link":{...},"Err":"key not found","Type":"not_found"}
+//
+// The same methods are offered over JSON-RPC 2.0 at jsonRPCPath, with
+// the method named "GetLink" or "Store.GetLink" and params a one-element
+// array holding the argument, or the argument itself if it is an
+// object. Errors carry the type in their data, and codes jsonRPCNotFound
+// and so on.
+//
+// Slaves use the JSON API instead of net/rpc when run with
+// -transport=json.
+
+const (
+	jsonPath    = "/_goto/"
+	jsonRPCPath = "/_goto/jsonrpc"
+	maxJSONBody = 32 << 20
+)
+
+// JSON-RPC 2.0 error codes: the standard ones, and one for each error
+// type.
+const (
+	jsonRPCParse          = -32700
+	jsonRPCInvalidRequest = -32600
+	jsonRPCNoMethod       = -32601
+	jsonRPCInvalidParams  = -32602
+	jsonRPCInternal       = -32000
+	jsonRPCNotFound       = -32001
+	jsonRPCConflict       = -32002
+	jsonRPCUnavailable    = -32003
+	jsonRPCInvalid        = -32004
+)
+
+// A JSONError is the error in a failed JSON API call.
+type JSONError struct {
+	Type    string
+	Message string
+}
+
+func (e *JSONError) Error() string { return e.Message }
+
+// jsonError classifies err for the JSON API.
+func jsonError(err error) *JSONError {
+	if e, ok := err.(*JSONError); ok {
+		return e
+	}
+	t := "internal"
+	switch errorStatus(err) {
+	case http.StatusNotFound, http.StatusGone:
+		t = "not_found"
+	case http.StatusConflict:
+		t = "conflict"
+	case http.StatusServiceUnavailable:
+		t = "unavailable"
+	case http.StatusBadRequest, http.StatusMisdirectedRequest:
+		t = "invalid"
+	}
+	return &JSONError{t, err.Error()}
+}
+
+func (e *JSONError) status() int {
+	switch e.Type {
+	case "not_found":
+		return http.StatusNotFound
+	case "conflict":
+		return http.StatusConflict
+	case "unavailable":
+		return http.StatusServiceUnavailable
+	case "invalid":
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func (e *JSONError) code() int {
+	switch e.Type {
+	case "not_found":
+		return jsonRPCNotFound
+	case "conflict":
+		return jsonRPCConflict
+	case "unavailable":
+		return jsonRPCUnavailable
+	case "invalid":
+		return jsonRPCInvalid
+	}
+	return jsonRPCInternal
+}
+
+var errNoMethod = &JSONError{"not_found", "no such method"}
+
+// A jsonMethod is a method of the form net/rpc would serve:
+//
+//	func (t *T) Name(args *A, reply *R) error
+//
+// where args may also be a value.
+type jsonMethod struct {
+	fn     reflect.Value
+	args   reflect.Type
+	argPtr bool
+	reply  reflect.Type
+}
+
+// call decodes the argument from params and calls the method.
+func (m jsonMethod) call(params []byte) (interface{}, error) {
+	args := reflect.New(m.args)
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, args.Interface()); err != nil {
+			return nil, &JSONError{"invalid", "bad argument: " + err.Error()}
+		}
+	}
+	if !m.argPtr {
+		args = args.Elem()
+	}
+	reply := reflect.New(m.reply)
+	if err, _ := m.fn.Call([]reflect.Value{args, reply})[0].Interface().(error); err != nil {
+		return nil, err
+	}
+	return reply.Interface(), nil
+}
+
+// jsonMethods are the methods the JSON API offers, and all that a
+// store offers over net/rpc (see rpcStore). Others with the shape of
+// an RPC method, such as Set, are left out, as they are not meant for
+// clients.
+var jsonMethods = []string{
+	// The Store interface.
+	"Put", "Get", "PutLink", "PutCustom", "GetLink", "GetMulti", "PutMulti",
+	"Delete", "Update", "Rollback", "History",
+	"AddNamespace", "DeleteNamespace", "Namespaces", "List",
+
+	// What slaves ask of their master.
+	"Register", "Heartbeat", "Changed", "KeyRules", "Lease", "Replicate",
+	"Follow", "Leader",
+
+	// What rebalance asks of the shards.
+	"Import",
+}
+
+// A masterStore is a store as a master serves it: the Store interface
+// and the calls slaves and rebalance make on it.
+type masterStore interface {
+	Store
+	Register(h *Heartbeat, _ *int) error
+	Heartbeat(h *Heartbeat, _ *int) error
+	Changed(since *int, c *Changes) error
+	KeyRules(_ *int, r *KeyRules) error
+	Lease(n *uint64, l *KeyLease) error
+	Replicate(links *[]CustomLink, n *int) error
+	Follow(fl *Follow, fd *Feed) error
+	Import(links *[]CustomLink, rs *[]Result) error
+}
+
+// An rpcStore is what a slave run with -rpc registers with net/rpc as
+// "Store". Only the methods of the interface it embeds are promoted to
+// it, so the store's other exported methods cannot be called remotely;
+// masterRPCStore and raftRPCStore do the same for masters.
+type rpcStore struct {
+	Store
+}
+
+// A masterRPCStore is the rpcStore of a master, so that Set and the
+// like stay private.
+type masterRPCStore struct {
+	masterStore
+}
+
+// A raftRPCStore is the rpcStore of a replicated master, which also
+// tells callers which node leads.
+type raftRPCStore struct {
+	masterRPCStore
+	raft *RaftStore
+}
+
+func (s raftRPCStore) Leader(_ *int, addr *string) error {
+	return s.raft.Leader(nil, addr)
+}
+
+// newRPCStore returns what to register with net/rpc for s.
+func newRPCStore(s Store) interface{} {
+	switch s := s.(type) {
+	case *RaftStore:
+		return raftRPCStore{masterRPCStore{s}, s}
+	case masterStore:
+		return masterRPCStore{s}
+	}
+	return rpcStore{s}
+}
+
+// A jsonAPI serves the jsonMethods of a receiver as JSON.
+type jsonAPI struct {
+	methods map[string]jsonMethod
+}
+
+func newJSONAPI(rcvr interface{}) *jsonAPI {
+	errType := reflect.TypeOf((*error)(nil)).Elem()
+	a := &jsonAPI{methods: make(map[string]jsonMethod)}
+	v := reflect.ValueOf(rcvr)
+	for _, name := range jsonMethods {
+		fn := v.MethodByName(name)
+		if !fn.IsValid() {
+			continue // Leader, unless replicated
+		}
+		t := fn.Type()
+		if t.NumIn() != 2 || t.NumOut() != 1 || t.Out(0) != errType || t.In(1).Kind() != reflect.Ptr {
+			panic("jsonapi: " + name + " is not an RPC method")
+		}
+		jm := jsonMethod{fn: fn, args: t.In(0), reply: t.In(1).Elem()}
+		if jm.args.Kind() == reflect.Ptr {
+			jm.args, jm.argPtr = jm.args.Elem(), true
+		}
+		a.methods[name] = jm
+	}
+	return a
+}
+
+func (a *jsonAPI) call(method string, params []byte) (interface{}, error) {
+	m, ok := a.methods[strings.TrimPrefix(method, "Store.")]
+	if !ok {
+		return nil, errNoMethod
+	}
+	return m.call(params)
+}
+
+// ServeHTTP serves the plain JSON API.
+func (a *jsonAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	var reply interface{}
+	if err == nil {
+		reply, err = a.call(strings.TrimPrefix(r.URL.Path, jsonPath), params)
+	} else {
+		err = &JSONError{"invalid", err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		e := jsonError(err)
+		w.WriteHeader(e.status())
+		json.NewEncoder(w).Encode(struct{ Error *JSONError }{e})
+		return
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+type jsonRPCRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonRPCResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonRPCError struct {
+	Code    int        `json:"code"`
+	Message string     `json:"message"`
+	Data    *JSONError `json:"data,omitempty"`
+}
+
+// ServeJSONRPC serves JSON-RPC 2.0, including batches.
+func (a *jsonAPI) ServeJSONRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		json.NewEncoder(w).Encode(jsonRPCFailure(nil, jsonRPCParse, err.Error()))
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		var req jsonRPCRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			json.NewEncoder(w).Encode(jsonRPCFailure(nil, jsonRPCParse, err.Error()))
+			return
+		}
+		if resp := a.serveRequest(req); resp != nil {
+			json.NewEncoder(w).Encode(resp)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	var reqs []json.RawMessage
+	if err := json.Unmarshal(body, &reqs); err != nil {
+		json.NewEncoder(w).Encode(jsonRPCFailure(nil, jsonRPCParse, err.Error()))
+		return
+	}
+	if len(reqs) == 0 {
+		json.NewEncoder(w).Encode(jsonRPCFailure(nil, jsonRPCInvalidRequest, "empty batch"))
+		return
+	}
+	var resps []*jsonRPCResponse
+	for _, b := range reqs {
+		var req jsonRPCRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			resps = append(resps, jsonRPCFailure(nil, jsonRPCInvalidRequest, err.Error()))
+		} else if resp := a.serveRequest(req); resp != nil {
+			resps = append(resps, resp)
+		}
+	}
+	if len(resps) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	json.NewEncoder(w).Encode(resps)
+}
+
+// serveRequest answers one JSON-RPC request, or returns nil if it is a
+// notification.
+func (a *jsonAPI) serveRequest(req jsonRPCRequest) *jsonRPCResponse {
+	var resp *jsonRPCResponse
+	switch params := bytes.TrimSpace(req.Params); {
+	case req.Version != "2.0" || req.Method == "":
+		resp = jsonRPCFailure(req.ID, jsonRPCInvalidRequest, "not a JSON-RPC 2.0 request")
+	case len(params) > 0 && params[0] == '[':
+		var list []json.RawMessage
+		if json.Unmarshal(params, &list) != nil || len(list) > 1 {
+			resp = jsonRPCFailure(req.ID, jsonRPCInvalidParams, "params must hold one argument")
+			break
+		}
+		params = nil
+		if len(list) == 1 {
+			params = list[0]
+		}
+		resp = a.callJSONRPC(req, params)
+	default:
+		resp = a.callJSONRPC(req, params)
+	}
+	if req.ID == nil {
+		return nil
+	}
+	return resp
+}
+
+func (a *jsonAPI) callJSONRPC(req jsonRPCRequest, params []byte) *jsonRPCResponse {
+	reply, err := a.call(req.Method, params)
+	switch {
+	case err == errNoMethod:
+		return jsonRPCFailure(req.ID, jsonRPCNoMethod, err.Error())
+	case err != nil:
+		e := jsonError(err)
+		code := e.code()
+		if _, ok := err.(*JSONError); ok {
+			// Only a bad argument fails before reaching the store.
+			code = jsonRPCInvalidParams
+		}
+		return &jsonRPCResponse{"2.0", nil, &jsonRPCError{code, e.Message, e}, req.ID}
+	}
+	return &jsonRPCResponse{"2.0", reply, nil, req.ID}
+}
+
+func jsonRPCFailure(id json.RawMessage, code int, msg string) *jsonRPCResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &jsonRPCResponse{"2.0", nil, &jsonRPCError{code, msg, nil}, id}
+}
+
+// A caller sends calls to the master over one connection.
+// *rpc.Client is a caller, as is *jsonClient.
+type caller interface {
+	Go(method string, args, reply interface{}, done chan *rpc.Call) *rpc.Call
+	Close() error
+}
+
+// dialMaster connects to the master at addr with the transport chosen
+// by the -transport flag.
+func dialMaster(addr string) (caller, error) {
+	if *transport == "json" {
+		return newJSONClient(addr), nil
+	}
+	return dialHTTP(addr, dialTimeout)
+}
+
+// A jsonClient calls the master through the JSON API. Errors returned
+// by the method come back as rpc.ServerError, as they would from
+// net/rpc, so that remoteError maps them to the store's own errors.
+type jsonClient struct {
+	url string
+	t   *http.Transport
+	c   *http.Client
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newJSONClient(addr string) *jsonClient {
+	t := &http.Transport{TLSClientConfig: clientTLS}
+	scheme := "http://"
+	if clientTLS != nil {
+		scheme = "https://"
+	}
+	return &jsonClient{
+		url: scheme + addr + jsonPath,
+		t:   t,
+		c:   &http.Client{Transport: t, Timeout: callTimeout},
+	}
+}
+
+func (c *jsonClient) Go(method string, args, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	call := &rpc.Call{ServiceMethod: method, Args: args, Reply: reply, Done: done}
+	go func() {
+		call.Error = c.call(method, args, reply)
+		call.Done <- call
+	}()
+	return call
+}
+
+func (c *jsonClient) call(method string, args, reply interface{}) error {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return rpc.ErrShutdown
+	}
+	b, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.url+strings.TrimPrefix(method, "Store."), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if rpcSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+rpcSecret)
+	}
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return json.NewDecoder(resp.Body).Decode(reply)
+	}
+	var e struct{ Error *JSONError }
+	if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == nil {
+		return errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	return rpc.ServerError(e.Error.Message)
+}
+
+func (c *jsonClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return rpc.ErrShutdown
+	}
+	c.closed = true
+	c.t.CloseIdleConnections()
+	return nil
+}
@@ -14,20 +14,332 @@
 
 package main
 
-var keyChar = []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
 
-func genKey(n int) string {
-	if n == 0 {
-		return string(keyChar[0])
+// alphabets are the character sets generated keys may be drawn from.
+// Crockford's base 32 leaves out letters easily mistaken for others
+// (i, l, o and u) and is read without regard to case.
+var alphabets = map[string]string{
+	"base62":    "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"crockford": "0123456789abcdefghjkmnpqrstvwxyz",
+}
+
+// A keyAlphabet is an alphabet in use: its name and characters.
+type keyAlphabet struct {
+	name  string
+	chars []byte
+}
+
+// curAlphabet holds the keyAlphabet in effect. A slave adopts its
+// master's each time it connects, while keys are being made.
+var curAlphabet atomic.Value
+
+func init() {
+	setAlphabet("base62")
+}
+
+// setAlphabet selects the alphabet for generated keys.
+func setAlphabet(name string) error {
+	a, ok := alphabets[name]
+	if !ok {
+		return fmt.Errorf("unknown alphabet %q", name)
+	}
+	curAlphabet.Store(keyAlphabet{name, []byte(a)})
+	return nil
+}
+
+// alphabet returns the name of the alphabet in effect.
+func alphabet() string {
+	return curAlphabet.Load().(keyAlphabet).name
+}
+
+// keyChars returns the characters of the alphabet in effect.
+func keyChars() []byte {
+	return curAlphabet.Load().(keyAlphabet).chars
+}
+
+// normalizeKey returns the canonical form of a key typed by hand.
+// In the crockford alphabet that means folding case and replacing
+// look-alike characters in the key's name (but not its namespace);
+// other alphabets are taken as they are.
+func normalizeKey(key string) string {
+	if alphabet() != "crockford" {
+		return key
+	}
+	ns, name := splitKey(key)
+	if ns != "" {
+		return ns + "/" + normalizeKey(name)
+	}
+	return strings.Map(func(r rune) rune {
+		switch r = unicode.ToLower(r); r {
+		case 'i', 'l':
+			return '1'
+		case 'o':
+			return '0'
+		}
+		return r
+	}, key)
+}
+
+const (
+	maxKeyLength = 64
+	maxKeyTries  = 10 // attempts at finding a free key, for generators that can repeat
+)
+
+// reservedKeys are paths served by something other than Redirect,
+// now or in future.
+var reservedKeys = map[string]bool{
+	"_goRPC_":     true,
+	"_goto":       true,
+	"add":         true,
+	"admin":       true,
+	"api":         true,
+	"cluster":     true,
+	"edit":        true,
+	"favicon.ico": true,
+	"health":      true,
+	"history":     true,
+	"list":        true,
+	"namespaces":  true,
+	"rollback":    true,
+	"robots.txt":  true,
+}
+
+// customKeyChar holds the characters allowed in custom keys, whatever
+// the alphabet for generated keys. genKey never uses '-' or '_', so
+// custom keys containing them can never collide with generated ones.
+var customKeyChar = []byte(alphabets["base62"] + "-_")
+
+// checkKey reports whether key may be chosen as a custom key: it must
+// be drawn from customKeyChar, no longer than maxKeyLength, and neither
+// reserved nor blocked.
+func checkKey(key string) error {
+	if reservedKeys[key] {
+		return errReserved
+	}
+	if blocklist().blocks(key) {
+		return errBlocked
+	}
+	if key == "" || len(key) > maxKeyLength {
+		return errBadKey
 	}
-	l := len(keyChar)
-	s := make([]byte, 20) // FIXME: will overflow. eventually.
+	for i := 0; i < len(key); i++ {
+		if bytes.IndexByte(customKeyChar, key[i]) < 0 {
+			return errBadKey
+		}
+	}
+	return nil
+}
+
+var errKeyRange = errors.New("key out of sequence range")
+
+func genKey(n uint64) string {
+	keyChar := keyChars()
+	l := uint64(len(keyChar))
+	var s [13]byte // 32^13 > 2^64, and no alphabet is smaller
 	i := len(s)
-	for n > 0 && i >= 0 {
+	for {
 		i--
-		j := n % l
-		n = (n - j) / l
-		s[i] = keyChar[j]
+		s[i] = keyChar[n%l]
+		n /= l
+		if n == 0 {
+			break
+		}
 	}
 	return string(s[i:])
 }
+
+// keySeq returns the sequence number from which genKey made key.
+func keySeq(key string) (uint64, error) {
+	keyChar := keyChars()
+	if key == "" || len(key) > 1 && key[0] == keyChar[0] {
+		return 0, errBadKey // genKey never makes leading zeros
+	}
+	l := uint64(len(keyChar))
+	var n uint64
+	for i := 0; i < len(key); i++ {
+		j := bytes.IndexByte(keyChar, key[i])
+		if j < 0 {
+			return 0, errBadKey
+		}
+		if n > (math.MaxUint64-uint64(j))/l {
+			return 0, errKeyRange
+		}
+		n = n*l + uint64(j)
+	}
+	return n, nil
+}
+
+// A KeyGenerator proposes keys for new links. URLStore calls Key with
+// increasing attempt numbers, starting from zero, until it is given a
+// key that is not taken or an error.
+type KeyGenerator interface {
+	Key(url string, attempt int) (string, error)
+}
+
+// NewKeyGenerator returns the named key generation strategy. Length
+// applies to the random, hash and words strategies.
+func NewKeyGenerator(name string, length int) (KeyGenerator, error) {
+	if length < 1 || length > maxKeyLength {
+		return nil, fmt.Errorf("key length must be between 1 and %d", maxKeyLength)
+	}
+	switch name {
+	case "sequential":
+		return new(sequentialKeys), nil
+	case "random":
+		return randomKeys(length), nil
+	case "hash":
+		return hashKeys(length), nil
+	case "words":
+		return wordKeys((length + 1) / 2), nil
+	}
+	return nil, fmt.Errorf("unknown key generator %q", name)
+}
+
+// A sequencer is a KeyGenerator that works through a sequence. Its
+// position is saved in the journal with the keys it makes, so that it
+// carries on from there after a restart.
+type sequencer interface {
+	KeyGenerator
+	Pos() uint64                      // the next sequence number to be used
+	Seek(pos uint64)                  // move to pos, unless already past it
+	Reserve(n uint64) (uint64, error) // skip n numbers, returning the first
+}
+
+// sequentialKeys counts upwards in base 62.
+type sequentialKeys struct {
+	n uint64 // accessed atomically
+}
+
+func (g *sequentialKeys) Key(url string, attempt int) (string, error) {
+	for {
+		n := atomic.LoadUint64(&g.n)
+		if n == math.MaxUint64 {
+			return "", errKeySpace
+		}
+		if atomic.CompareAndSwapUint64(&g.n, n, n+1) {
+			return genKey(n), nil
+		}
+	}
+}
+
+func (g *sequentialKeys) Pos() uint64 {
+	return atomic.LoadUint64(&g.n)
+}
+
+func (g *sequentialKeys) Reserve(n uint64) (uint64, error) {
+	for {
+		pos := atomic.LoadUint64(&g.n)
+		if pos > math.MaxUint64-n {
+			return 0, errKeySpace
+		}
+		if atomic.CompareAndSwapUint64(&g.n, pos, pos+n) {
+			return pos, nil
+		}
+	}
+}
+
+func (g *sequentialKeys) Seek(pos uint64) {
+	for {
+		n := atomic.LoadUint64(&g.n)
+		if n >= pos || atomic.CompareAndSwapUint64(&g.n, n, pos) {
+			return
+		}
+	}
+}
+
+// randomKeys chooses keys of the given length uniformly at random.
+type randomKeys int
+
+func (g randomKeys) Key(url string, attempt int) (string, error) {
+	if attempt >= keyTries() {
+		return "", errKeySpace
+	}
+	keyChar := keyChars()
+	b := make([]byte, g)
+	for i := range b {
+		b[i] = keyChar[randIntn(len(keyChar))]
+	}
+	return string(b), nil
+}
+
+// hashKeys derives keys of the given length from a SHA-256 hash of the
+// URL, so the same URL tends to get the same key. Retries hash the URL
+// together with the attempt number.
+type hashKeys int
+
+func (g hashKeys) Key(url string, attempt int) (string, error) {
+	if attempt >= keyTries() {
+		return "", errKeySpace
+	}
+	if attempt > 0 {
+		url += "\x00" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(url))
+	n := new(big.Int).SetBytes(sum[:])
+	keyChar := keyChars()
+	l := big.NewInt(int64(len(keyChar)))
+	b := make([]byte, g)
+	m := new(big.Int)
+	for i := range b {
+		n.DivMod(n, l, m)
+		b[i] = keyChar[m.Int64()]
+	}
+	return string(b), nil
+}
+
+// wordKeys makes pronounceable keys from the given number of random
+// consonant-vowel syllables, such as "lomipa". Only letters in the
+// alphabet in effect are used, so crockford keys have fewer syllables
+// to choose from, such as "depaka".
+type wordKeys int
+
+const (
+	consonants = "bdfghjklmnprstvz"
+	vowels     = "aeiou"
+)
+
+func (g wordKeys) Key(url string, attempt int) (string, error) {
+	if attempt >= keyTries() {
+		return "", errKeySpace
+	}
+	cs, vs := inAlphabet(consonants), inAlphabet(vowels)
+	b := make([]byte, 0, 2*g)
+	for i := 0; i < int(g); i++ {
+		b = append(b, cs[randIntn(len(cs))], vs[randIntn(len(vs))])
+	}
+	return string(b), nil
+}
+
+// inAlphabet returns the characters of s that are in the alphabet in
+// effect.
+func inAlphabet(s string) string {
+	keyChar := string(keyChars())
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(keyChar, r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// randIntn returns a cryptographically random int in [0, n).
+func randIntn(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(i.Int64())
+}
@@ -0,0 +1,98 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestKeySeqRoundTrip(t *testing.T) {
+	defer setAlphabet("base62")
+	for _, name := range []string{"base62", "crockford"} {
+		if err := setAlphabet(name); err != nil {
+			t.Fatal(err)
+		}
+		l := uint64(len(keyChars()))
+		for _, n := range []uint64{
+			0, 1, l - 1, l, l + 1, l*l - 1, l * l,
+			math.MaxUint32, math.MaxUint64 / l, math.MaxUint64 - 1, math.MaxUint64,
+		} {
+			key := genKey(n)
+			got, err := keySeq(key)
+			if err != nil || got != n {
+				t.Errorf("%s: keySeq(genKey(%d) = %q) = %d, %v", name, n, key, got, err)
+			}
+		}
+	}
+}
+
+func TestKeySeqErrors(t *testing.T) {
+	defer setAlphabet("base62")
+	tests := []struct {
+		alphabet string
+		key      string
+		err      error
+	}{
+		{"base62", "", errBadKey},
+		{"base62", "0a", errBadKey},    // leading zero
+		{"base62", "a-b", errBadKey},   // not in the alphabet
+		{"crockford", "A", errBadKey},  // crockford keys are lower case
+		{"crockford", "il", errBadKey}, // look-alikes are not in it
+		{"base62", strings.Repeat("Z", 11), errKeyRange},
+		{"crockford", strings.Repeat("z", 13), errKeyRange},
+	}
+	for _, tt := range tests {
+		setAlphabet(tt.alphabet)
+		if n, err := keySeq(tt.key); err != tt.err {
+			t.Errorf("%s: keySeq(%q) = %d, %v; want %v", tt.alphabet, tt.key, n, err, tt.err)
+		}
+	}
+	// One past the largest key.
+	for _, name := range []string{"base62", "crockford"} {
+		setAlphabet(name)
+		max := genKey(math.MaxUint64)
+		keyChar := keyChars()
+		next := strings.IndexByte(string(keyChar), max[len(max)-1]) + 1
+		if next == len(keyChar) {
+			continue // would carry; covered by the cases above
+		}
+		key := max[:len(max)-1] + string(keyChar[next])
+		if _, err := keySeq(key); err != errKeyRange {
+			t.Errorf("%s: keySeq(%q) = %v, want errKeyRange", name, key, err)
+		}
+	}
+}
+
+func TestWordKeysAlphabet(t *testing.T) {
+	defer setAlphabet("base62")
+	for _, name := range []string{"base62", "crockford"} {
+		setAlphabet(name)
+		keyChar := string(keyChars())
+		for i := 0; i < 100; i++ {
+			key, err := wordKeys(3).Key("http://golang.org/", 0)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if len(key) != 6 || strings.Trim(key, keyChar) != "" {
+				t.Errorf("%s: word key %q is not 6 characters of the alphabet", name, key)
+			}
+			if normalizeKey(key) != key {
+				t.Errorf("%s: word key %q is not in normal form", name, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Slaves may lease blocks of the master's key sequence and make keys
+// from them without asking the master. The keys they make are written
+// to a local lease file and sent on to the master in the background;
+// they stay in the file until the master has them, so nothing is lost
+// if the slave restarts in the meantime.
+
+const (
+	maxLease        = 1e6
+	replicateBatch  = 1000
+	replicateWindow = 1e9
+)
+
+// A KeyLease grants the sequence numbers [Start, End) to a slave.
+// Taken lists numbers in the range whose keys, in any spelling, were
+// already in use on the master when the lease was granted.
+type KeyLease struct {
+	Start, End uint64
+	Taken      []uint64 `json:",omitempty"`
+}
+
+// Lease reserves n numbers from the store's key sequence for the
+// caller's exclusive use.
+func (s *URLStore) Lease(n *uint64, l *KeyLease) error {
+	defer statSend("store lease")
+	g, ok := s.keys.(sequencer)
+	if !ok {
+		return errors.New("store does not lease keys")
+	}
+	if *n == 0 || *n > maxLease {
+		return errors.New("bad lease size")
+	}
+	s.order.Lock()
+	start, err := g.Reserve(*n)
+	if err != nil {
+		s.order.Unlock()
+		return err
+	}
+	if err := s.log(record{Next: start + *n}, nil); err != nil {
+		return err
+	}
+	*l = KeyLease{Start: start, End: start + *n}
+	s.mu.RLock()
+	for i := l.Start; i < l.End; i++ {
+		k := genKey(i)
+		_, used := s.urls[k]
+		if _, folded := s.folded[k]; used || folded {
+			l.Taken = append(l.Taken, i)
+		}
+	}
+	s.mu.RUnlock()
+	return nil
+}
+
+// Replicate stores links that slaves have made from their leases.
+// Links already present with the same URL are skipped, so a slave may
+// safely send them again; n counts those stored. Links with keys that
+// no lease could have made are refused and logged.
+func (s *URLStore) Replicate(links *[]CustomLink, n *int) error {
+	for _, c := range *links {
+		if err := s.checkLeased(c.Key); err != nil {
+			log.Printf("URLStore: refused replicated key %q: %v", c.Key, err)
+			statSend("store replicate refused")
+			continue
+		}
+		now := time.Now().Unix()
+		s.order.Lock()
+		if err := s.set(c.Key, c.Link, now); err == errKeyExists {
+			s.order.Unlock()
+			s.mu.RLock()
+			u := s.urls[c.Key]
+			s.mu.RUnlock()
+			if u != c.URL {
+				log.Printf("URLStore: replicated key %q conflicts with existing link", c.Key)
+				statSend("store replicate conflict")
+			}
+			continue
+		} else if err != nil {
+			s.order.Unlock()
+			return err
+		}
+		if err := s.logPut(*putRecord(c.Key, c.Link, 0, now)); err != nil {
+			return err
+		}
+		*n++
+	}
+	return nil
+}
+
+// checkLeased reports whether key is one a slave could have made from
+// a lease: a generated key in the root namespace, from a number already
+// given out, that the store may hold.
+func (s *URLStore) checkLeased(key string) error {
+	g, ok := s.keys.(sequencer)
+	if !ok {
+		return errors.New("store does not lease keys")
+	}
+	n, err := keySeq(key)
+	if err != nil {
+		return errBadKey
+	}
+	if n >= g.Pos() {
+		return errors.New("key not leased")
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if !keyAllowed(key) {
+		return errBlocked
+	}
+	if !ownsKey(key) {
+		return errWrongShard
+	}
+	return nil
+}
+
+// A keyLeaser makes keys for a ProxyStore from leases on the master.
+type keyLeaser struct {
+	mu      sync.Mutex
+	size    uint64
+	lease   KeyLease
+	next    uint64 // next number to use from lease
+	j       *journal
+	pending []CustomLink // made here but not yet stored by the master
+}
+
+// EnableLeasing makes s lease size numbers at a time from the master's
+// key sequence, keeping its lease and the links made from it in
+// filename.
+func (s *ProxyStore) EnableLeasing(filename string, size int) error {
+	l := &keyLeaser{size: uint64(size)}
+	var seq uint64
+	_, err := readJournal(filename, true, func(n uint64, r record) {
+		seq = n
+		switch {
+		case r.Lease != nil:
+			l.lease = *r.Lease
+			l.next = r.Lease.Start
+		case r.Key != "":
+			c := CustomLink{Key: r.Key, Link: Link{URL: r.URL, Author: r.Author}}
+			if r.Expires != 0 {
+				c.Expires = time.Unix(r.Expires, 0)
+			}
+			l.pending = append(l.pending, c)
+			s.urls.pin(c.Key, c.Link)
+			if r.Next > l.next {
+				l.next = r.Next
+			}
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if l.j, err = openJournal(filename, seq); err != nil {
+		return err
+	}
+	s.lease = l
+	go s.replicateLoop()
+	return nil
+}
+
+// leasedKey makes a key for url from the current lease, taking out a
+// new lease if need be, and saves it to the lease file.
+func (s *ProxyStore) leasedKey(l Link) (string, error) {
+	if !s.rulesKnown() {
+		// Keys made now might use the wrong alphabet, or be blocked.
+		return "", errUnavailable
+	}
+	kl := s.lease
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	var key string
+	for key == "" {
+		if kl.next >= kl.lease.End {
+			if err := s.renewLease(); err != nil {
+				return "", err
+			}
+		}
+		n := kl.next
+		kl.next++
+		if k := genKey(n); !kl.taken(n) && keyAllowed(k) {
+			key = k
+		}
+	}
+	r := record{Key: key, URL: l.URL, Author: l.Author, Next: kl.next, Time: time.Now().Unix()}
+	if !l.Expires.IsZero() {
+		r.Expires = l.Expires.Unix()
+	}
+	err := kl.j.append(r)
+	if err == nil && syncEvery == syncAlways {
+		err = kl.j.sync()
+	} else if err == nil {
+		err = kl.j.flush()
+	}
+	if err != nil {
+		return "", err
+	}
+	kl.pending = append(kl.pending, CustomLink{Key: key, Link: l})
+	s.urls.pin(key, l)
+	return key, nil
+}
+
+func (kl *keyLeaser) taken(n uint64) bool {
+	for _, t := range kl.lease.Taken {
+		if t == n {
+			return true
+		}
+	}
+	return false
+}
+
+// renewLease takes out a new lease from the master and records it in
+// the lease file. The caller must hold s.lease.mu.
+func (s *ProxyStore) renewLease() error {
+	kl := s.lease
+	var l KeyLease
+	if err := s.client.Call("Store.Lease", &kl.size, &l); err != nil {
+		return remoteError(err)
+	}
+	if err := kl.j.append(record{Lease: &l}); err != nil {
+		return err
+	}
+	if err := kl.j.sync(); err != nil {
+		return err
+	}
+	kl.lease, kl.next = l, l.Start
+	return nil
+}
+
+// replicateLoop sends the links made from leases to the master.
+func (s *ProxyStore) replicateLoop() {
+	for {
+		time.Sleep(replicateWindow)
+		if err := s.replicate(); err != nil {
+			log.Println("ProxyStore: replicate:", err)
+		}
+	}
+}
+
+// replicate sends pending links to the master. Once the master has
+// them all, the lease file is cut back to just the current lease.
+func (s *ProxyStore) replicate() error {
+	kl := s.lease
+	for {
+		kl.mu.Lock()
+		if syncEvery != syncNone {
+			kl.j.sync()
+		}
+		batch := kl.pending
+		if len(batch) > replicateBatch {
+			batch = batch[:replicateBatch]
+		}
+		kl.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		var n int
+		if err := s.client.Call("Store.Replicate", &batch, &n); err != nil {
+			return remoteError(err)
+		}
+		kl.mu.Lock()
+		kl.pending = append([]CustomLink(nil), kl.pending[len(batch):]...)
+		for _, c := range batch {
+			s.urls.unpin(c.Key)
+		}
+		var err error
+		if len(kl.pending) == 0 {
+			err = kl.compact()
+		}
+		kl.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compact truncates the lease file, leaving only what remains of the
+// current lease. The caller must hold kl.mu.
+func (kl *keyLeaser) compact() error {
+	rest := KeyLease{Start: kl.next, End: kl.lease.End}
+	for _, t := range kl.lease.Taken {
+		if t >= kl.next {
+			rest.Taken = append(rest.Taken, t)
+		}
+	}
+	if err := kl.j.truncate(); err != nil {
+		return err
+	}
+	if rest.Start < rest.End {
+		if err := kl.j.append(record{Lease: &rest}); err != nil {
+			return err
+		}
+	}
+	return kl.j.sync()
+}
+
+// closeLease sends what it can to the master and closes the lease file.
+func (s *ProxyStore) closeLease() error {
+	if err := s.replicate(); err != nil {
+		log.Println("ProxyStore: replicate:", err)
+	}
+	s.lease.mu.Lock()
+	defer s.lease.mu.Unlock()
+	return s.lease.j.close()
+}
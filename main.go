@@ -15,34 +15,180 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/nf/stat"
+	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var (
 	listenAddr = flag.String("http", ":8080", "http listen address")
 	dataFile   = flag.String("file", "store.json", "data store file name")
 	hostname   = flag.String("host", "localhost:8080", "http host name")
-	masterAddr = flag.String("master", "", "RPC master address")
+	masterAddr = flag.String("master", "", "RPC master address, or comma-separated addresses of a replicated cluster")
 	rpcEnabled = flag.Bool("rpc", false, "enable RPC server")
 	statServer = flag.String("stats", "", "stat server address")
+	dedup      = flag.Bool("dedup", false, "return the existing key when a URL is added again")
+	keyGen     = flag.String("keygen", "sequential", "key generator: sequential, random, hash or words")
+	keyLen     = flag.Int("keylen", 7, "length of random, hash and words keys")
+	leaseSize  = flag.Int("lease", 0, "key sequence numbers a slave leases from the master at a time (0 disables)")
+	leaseFile  = flag.String("leasefile", "", "file holding a slave's key lease (default lease-<http port>.json)")
+	blockFile  = flag.String("blocklist", "", "file of rules for keys that must not be used")
+	keyAlpha   = flag.String("alphabet", "base62", "alphabet for generated keys: base62, or crockford for case-insensitive keys without look-alike characters")
+	compactMax = flag.Int("compact", 100000, "compact the data file after this many records (0 disables)")
+	cacheSize  = flag.Int("cachesize", 1000000, "most links a slave caches (0 for no limit)")
+	cacheMem   = flag.Int("cachemem", 256<<20, "approximate bytes of links a slave caches (0 for no limit)")
+	cacheTTL   = flag.Duration("cachettl", 0, "how long a slave caches a link before asking the master again (0 for ever)")
+	peerAddrs  = flag.String("peers", "", "comma-separated RPC addresses of all the nodes in a replicated cluster")
+	selfAddr   = flag.String("self", "", "this node's address among -peers or -shards (default the -http address, on localhost if it names no host), or a slave's address as it reports it to the master (default this machine's name and the -http port)")
+	replFile   = flag.String("replica", "", "file in which a slave keeps a copy of all the master's links (empty disables)")
+	shardList  = flag.String("shards", "", "comma-separated RPC addresses of the masters sharing the keyspace")
+	transport  = flag.String("transport", "gob", "how a slave calls the master: gob (net/rpc) or json (the JSON API)")
+	tlsCert    = flag.String("tlscert", "", "certificate file: masters serve TLS with it, slaves present it to the master")
+	tlsKey     = flag.String("tlskey", "", "private key file for -tlscert")
+	tlsCA      = flag.String("tlsca", "", "CA certificate file: masters take RPC only from certificates it signed, slaves check the master's against it")
+	rpcToken   = flag.String("rpctoken", "", "file holding a secret that RPC callers must present (empty disables)")
+	rebalFrom  = flag.String("rebalance", "", "move keys from these comma-separated old -shards to their owners under -shards, then exit")
+	oldShards  = flag.String("oldshards", "", "on a slave, the comma-separated -shards from before the last change, to look for keys on until -rebalance has moved them")
+	adminOn    = flag.Bool("admin", false, "serve /edit, /rollback, /list and /namespaces, which change or enumerate links, to callers with the -rpctoken secret or a -tlsca certificate, if set")
 )
 
+const shutdownTimeout = 30e9
+
+var syncEvery = syncNone
+
+func init() {
+	flag.Var(&syncEvery, "fsync", `data file fsync policy: "always", "none", or a group commit interval such as "10ms"`)
+}
+
 var store Store
 
+// linkScheme is the scheme of the links handlers print: "https" when
+// the server takes only TLS.
+var linkScheme = "http"
+
+// shortURL returns the link to key on this server.
+func shortURL(key string) string {
+	return linkScheme + "://" + *hostname + "/" + key
+}
+
 func main() {
 	flag.Parse()
-	if *masterAddr != "" {
-		store = NewProxyStore(*masterAddr)
+	if err := setAlphabet(*keyAlpha); err != nil {
+		log.Fatal(err)
+	}
+	if *transport != "gob" && *transport != "json" {
+		log.Fatal("-transport must be gob or json")
+	}
+	serverTLS, err := setupAuth(*tlsCert, *tlsKey, *tlsCA, *rpcToken)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *blockFile != "" {
+		kf, err := loadKeyFilter(*blockFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		setBlocklist(kf)
+	}
+	var shards []string
+	if *shardList != "" {
+		shards = strings.Split(*shardList, ",")
+		if *masterAddr != "" || *peerAddrs != "" || *leaseSize > 0 || *replFile != "" {
+			log.Fatal("-shards cannot be combined with -master, -peers, -lease or -replica")
+		}
+	}
+	self := nodeAddr()
+	if *rebalFrom != "" {
+		if shards == nil {
+			log.Fatal("-rebalance needs the new -shards")
+		}
+		if err := rebalance(strings.Split(*rebalFrom, ","), newHashRing(shards)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *masterAddr != "" || shards != nil && !*rpcEnabled {
+		var p *ProxyStore
+		if *masterAddr != "" {
+			p = NewProxyStore(*masterAddr)
+		} else {
+			p = NewShardedProxyStore(shards)
+		}
+		if *oldShards != "" {
+			if shards == nil {
+				log.Fatal("-oldshards needs -shards")
+			}
+			p.EnablePreviousShards(strings.Split(*oldShards, ","))
+		}
+		if *leaseSize > 0 {
+			name := *leaseFile
+			if name == "" {
+				name = "lease" + strings.Replace(*listenAddr, ":", "-", -1) + ".json"
+			}
+			if err := p.EnableLeasing(name, *leaseSize); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *replFile != "" {
+			if err := p.EnableReplica(*replFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		store = p
 	} else {
-		store = NewURLStore(*dataFile)
+		keys, err := NewKeyGenerator(*keyGen, *keyLen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if shards != nil {
+			shardRing = newHashRing(shards)
+			if !shardRing.has(self) {
+				log.Fatalf("-self %s is not among -shards", self)
+			}
+			shardSelf = self
+		}
+		if *peerAddrs != "" {
+			s, err := NewRaftStore(self, strings.Split(*peerAddrs, ","), *dataFile, keys)
+			if err != nil {
+				log.Fatal(err)
+			}
+			rpc.RegisterName("Raft", s.node)
+			*rpcEnabled = true
+			store = s
+		} else {
+			store = NewURLStore(*dataFile, keys)
+		}
 	}
 	if *rpcEnabled {
-		rpc.RegisterName("Store", store)
-		rpc.HandleHTTP()
+		rcvr := newRPCStore(store)
+		rpc.RegisterName("Store", rcvr)
+		if serverTLS == nil && *tlsCA != "" {
+			log.Fatal("-tlsca on a master needs -tlscert and -tlskey")
+		}
+		http.Handle(rpc.DefaultRPCPath, rpcAuth(rpcConns))
+		api := newJSONAPI(rcvr)
+		http.Handle(jsonPath, rpcAuth(api))
+		http.Handle(jsonRPCPath, rpcAuth(http.HandlerFunc(api.ServeJSONRPC)))
+		if serverTLS != nil {
+			linkScheme = "https"
+		}
+	} else {
+		serverTLS = nil // the certificate is only for calling the master
 	}
 	if *statServer != "" {
 		stat.Process = *listenAddr
@@ -50,8 +196,101 @@ func main() {
 	}
 	http.HandleFunc("/", Redirect)
 	http.HandleFunc("/add", Add)
-	http.ListenAndServe(*listenAddr, nil)
+	if *adminOn {
+		http.Handle("/edit", rpcAuth(http.HandlerFunc(EditURL)))
+		http.Handle("/rollback", rpcAuth(http.HandlerFunc(RollbackURL)))
+		http.Handle("/namespaces", rpcAuth(http.HandlerFunc(Namespaces)))
+		http.Handle("/list", rpcAuth(http.HandlerFunc(List)))
+	}
+	http.HandleFunc("/history", History)
+	http.HandleFunc("/health", Health)
+	http.HandleFunc("/cluster", Cluster)
+	srv := &http.Server{Addr: *listenAddr, ConnContext: rpcConns.connContext, TLSConfig: serverTLS}
+	go func() {
+		var err error
+		if serverTLS != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	os.Exit(shutdown(srv))
+}
+
+// nodeAddr returns this node's address among -peers or -shards: -self
+// if set, otherwise the -http address, with localhost for the host if
+// it names none or listens on every interface.
+func nodeAddr() string {
+	if *selfAddr != "" {
+		return *selfAddr
+	}
+	host, port, err := net.SplitHostPort(*listenAddr)
+	if err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// shutdown stops srv, letting in-flight requests finish, closes any
+// RPC connections, and then closes the store. It returns the exit
+// status: zero only if everything was saved.
+func shutdown(srv *http.Server) int {
+	log.Println("shutting down")
+	status := 0
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+		status = 1
+	}
+	rpcConns.closeAll()
+	if err := store.Close(); err != nil {
+		log.Println("shutdown:", err)
+		status = 1
+	}
+	return status
+}
 
+// rpcConns tracks the connections hijacked by the RPC server, which
+// http.Server.Shutdown neither waits for nor closes.
+var rpcConns = &connTracker{conns: make(map[net.Conn]bool)}
+
+type connKey struct{}
+
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func (t *connTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+func (t *connTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, _ := r.Context().Value(connKey{}).(net.Conn)
+	t.mu.Lock()
+	t.conns[c] = true
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.conns, c)
+		t.mu.Unlock()
+	}()
+	rpc.DefaultServer.ServeHTTP(w, r)
+}
+
+func (t *connTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.conns {
+		c.Close()
+	}
 }
 
 func Redirect(w http.ResponseWriter, r *http.Request) {
@@ -61,32 +300,268 @@ func Redirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var url string
-	if err := store.Get(&key, &url); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	err := store.Get(&key, &url)
+	if n := normalizeKey(key); err == errNotFound && n != key {
+		err = store.Get(&n, &url)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
+// errorStatus returns the HTTP status code for an error from the store.
+func errorStatus(err error) int {
+	switch err {
+	case errNotFound:
+		return http.StatusNotFound
+	case errExpired:
+		return http.StatusGone
+	case errNoNamespace:
+		return http.StatusNotFound
+	case errKeyExists, errReserved, errNamespaceExists, errNamespaceInUse:
+		return http.StatusConflict
+	case errBadKey, errBlocked:
+		return http.StatusBadRequest
+	case errWrongShard:
+		return http.StatusMisdirectedRequest
+	case errClosed, errBusy, errDegraded, errUnavailable, errCallTimeout,
+		errNotLeader, errNoLeader, errUncommitted:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
 func Add(w http.ResponseWriter, r *http.Request) {
 	url := r.FormValue("url")
 	if url == "" {
 		fmt.Fprint(w, AddForm)
 		return
 	}
+	l := Link{URL: url, Namespace: r.FormValue("ns"), Author: author(r)}
+	if ttl := r.FormValue("ttl"); ttl != "" {
+		d, err := parseTTL(ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l.Expires = time.Now().Add(d)
+	} else if exp := r.FormValue("expires"); exp != "" {
+		t, err := time.Parse(time.RFC3339, exp)
+		if err != nil {
+			http.Error(w, "bad expires: want RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		l.Expires = t
+	}
+	if !l.Expires.IsZero() && !l.Expires.After(time.Now()) {
+		http.Error(w, "bad expires: not in the future", http.StatusBadRequest)
+		return
+	}
 	var key string
-	if err := store.Put(&url, &key); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var err error
+	if k := r.FormValue("key"); k != "" {
+		if l.Namespace != "" {
+			k = l.Namespace + "/" + k
+		}
+		err = store.PutCustom(&CustomLink{Key: k, Link: l}, &key)
+	} else {
+		err = store.PutLink(&l, &key)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
-	fmt.Fprintf(w, "http://%s/%s", *hostname, key)
+	fmt.Fprint(w, shortURL(key))
+}
+
+// parseTTL parses a duration as time.ParseDuration does, but also
+// accepts a whole number of days, such as "7d".
+func parseTTL(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		if err == nil && n > 0 && n <= math.MaxInt64/int64(24*time.Hour) {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.New("bad ttl: want a duration such as 12h or 7d")
+	}
+	return d, nil
+}
+
+func EditURL(w http.ResponseWriter, r *http.Request) {
+	e := Edit{Key: r.FormValue("key"), URL: r.FormValue("url"), Author: author(r)}
+	if e.Key == "" || e.URL == "" {
+		fmt.Fprint(w, EditForm)
+		return
+	}
+	var old string
+	if err := store.Update(&e, &old); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "%s now points to %s (was %s)", shortURL(e.Key), e.URL, old)
+}
+
+func History(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	var h []Version
+	if err := store.History(&key, &h); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	for i, v := range h {
+		t := "-"
+		if !v.Time.IsZero() {
+			t = v.Time.UTC().Format(time.RFC3339)
+		}
+		a := v.Author
+		if a == "" {
+			a = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i+1, t, a, v.URL)
+	}
+}
+
+func RollbackURL(w http.ResponseWriter, r *http.Request) {
+	v, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		http.Error(w, "bad version", http.StatusBadRequest)
+		return
+	}
+	rb := Rollback{Key: r.FormValue("key"), Version: v, Author: author(r)}
+	var url string
+	if err := store.Rollback(&rb, &url); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "%s now points to %s", shortURL(rb.Key), url)
+}
+
+func Health(w http.ResponseWriter, r *http.Request) {
+	err := store.Health()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "status: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "status: ok\n")
+	}
+	if s, ok := store.(*URLStore); ok {
+		fmt.Fprintf(w, "queue: %d/%d\n", s.QueueLen(), saveQueueLength)
+	}
+	if s, ok := store.(*RaftStore); ok {
+		st := s.Status()
+		fmt.Fprintf(w, "node: %s\n", st.Self)
+		fmt.Fprintf(w, "role: %s in term %d\n", st.Role, st.Term)
+		fmt.Fprintf(w, "leader: %s\n", st.Leader)
+		fmt.Fprintf(w, "journal: %d records, %d committed\n", st.Last, st.Commit)
+	}
+	if s, ok := store.(*ProxyStore); ok {
+		fmt.Fprintf(w, "cache: %d links, %d bytes\n", s.urls.Len(), s.urls.Size())
+		if s.replica != nil {
+			n, seq := s.replica.Status()
+			fmt.Fprintf(w, "replica: %d links, seq %d\n", n, seq)
+		}
+		for _, m := range s.Masters() {
+			fmt.Fprintf(w, "master: %s\n", m.Addr)
+			fmt.Fprintf(w, "connected: %v\n", m.Connected)
+			if !m.LastOK.IsZero() {
+				fmt.Fprintf(w, "last ok: %v\n", m.LastOK.Format(time.RFC3339))
+			}
+			if m.Failures > 0 {
+				fmt.Fprintf(w, "failures: %d\n", m.Failures)
+				fmt.Fprintf(w, "last error: %s\n", m.LastError)
+				fmt.Fprintf(w, "retry: %v\n", m.Retry.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+// Namespaces lists the namespaces, or creates one if given a name.
+func Namespaces(w http.ResponseWriter, r *http.Request) {
+	if name := r.FormValue("name"); name != "" {
+		var ns Namespace
+		if err := store.AddNamespace(&Namespace{Name: name, Owner: author(r)}, &ns); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		fmt.Fprintf(w, "created namespace %s\n", ns.Name)
+		return
+	}
+	var list []Namespace
+	if err := store.Namespaces(new(int), &list); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	for _, ns := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", ns.Name, ns.Owner, ns.Created.UTC().Format(time.RFC3339))
+	}
+}
+
+// List lists the keys in the namespace given by the "ns" form value,
+// or in the root namespace if there is none.
+func List(w http.ResponseWriter, r *http.Request) {
+	ns := r.FormValue("ns")
+	var keys []string
+	if err := store.List(&ns, &keys); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	for _, k := range keys {
+		fmt.Fprintln(w, shortURL(k))
+	}
+}
+
+// Cluster shows the slaves registered with this master, as HTML, or as
+// JSON given "format=json" or a request that accepts only JSON.
+func Cluster(w http.ResponseWriter, r *http.Request) {
+	s, ok := store.(interface{ Members() []Member })
+	if !ok {
+		http.Error(w, "not a master", http.StatusNotFound)
+		return
+	}
+	st := ClusterStatus{Master: *hostname, Version: version, Members: s.Members()}
+	if r.FormValue("format") == "json" || r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := clusterPage.Execute(w, st); err != nil {
+		log.Println("cluster:", err)
+	}
+}
+
+// author names whoever is making a change, from the "author" form
+// value. The client's address is not used, as /history shows authors
+// to anyone.
+func author(r *http.Request) string {
+	return r.FormValue("author")
 }
 
 const AddForm = `
 <html><body>
 <form method="POST" action="/add">
 URL: <input type="text" name="url">
+Namespace (optional): <input type="text" name="ns">
+Key (optional): <input type="text" name="key">
+Expires after: <input type="text" name="ttl" placeholder="e.g. 7d">
+Author: <input type="text" name="author">
 <input type="submit" value="Add">
 </form>
 </body></html>
 `
+
+const EditForm = `
+<html><body>
+<form method="POST" action="/edit">
+Key: <input type="text" name="key">
+URL: <input type="text" name="url">
+Author: <input type="text" name="author">
+<input type="submit" value="Edit">
+</form>
+</body></html>
+`
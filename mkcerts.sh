@@ -0,0 +1,29 @@
+#!/bin/sh
+
+# Makes a throwaway certificate authority and a certificate it signs for
+# localhost, for trying out the -tlscert, -tlskey and -tlsca flags on one
+# machine. The same certificate serves masters and slaves:
+#
+#	./mkcerts.sh certs
+#	./goto -rpc -http=:8081 -tlscert=certs/node.pem -tlskey=certs/node-key.pem -tlsca=certs/ca.pem &
+#	./goto -master=localhost:8081 -tlscert=certs/node.pem -tlskey=certs/node-key.pem -tlsca=certs/ca.pem
+
+set -e
+dir=${1:-certs}
+mkdir -p $dir
+cd $dir
+
+openssl req -x509 -newkey rsa:2048 -nodes -days 365 \
+	-keyout ca-key.pem -out ca.pem -subj "/CN=goto test CA" 2>/dev/null
+
+cat > node.ext <<END
+subjectAltName = DNS:localhost, IP:127.0.0.1, IP:::1
+extendedKeyUsage = serverAuth, clientAuth
+END
+openssl req -newkey rsa:2048 -nodes \
+	-keyout node-key.pem -out node.csr -subj "/CN=localhost" 2>/dev/null
+openssl x509 -req -in node.csr -CA ca.pem -CAkey ca-key.pem -CAcreateserial \
+	-days 365 -extfile node.ext -out node.pem 2>/dev/null
+rm node.csr node.ext ca.srl
+
+echo "wrote $dir/ca.pem, $dir/node.pem and $dir/node-key.pem"
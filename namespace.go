@@ -0,0 +1,267 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Keys may live in namespaces, such as "infra" in "infra/dash", so
+// that teams can pick short keys without treading on each other.
+// Namespaced keys share the store's maps under their full names, but
+// each namespace makes keys from its own sequence.
+
+var (
+	errNoNamespace     = errors.New("no such namespace")
+	errNamespaceExists = errors.New("namespace already exists")
+	errNamespaceInUse  = errors.New("namespace is not empty")
+)
+
+// A Namespace is a separate space of keys.
+type Namespace struct {
+	Name    string
+	Owner   string
+	Created time.Time
+}
+
+type namespace struct {
+	Namespace
+	keys KeyGenerator
+}
+
+// splitKey splits a key into its namespace, empty for the root, and
+// its name within the namespace.
+func splitKey(key string) (ns, name string) {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// checkNamespace reports whether name may be used for a namespace: a
+// series of valid custom keys separated by slashes.
+func checkNamespace(name string) error {
+	if name == "" || len(name) > maxKeyLength {
+		return errBadKey
+	}
+	for _, part := range strings.Split(name, "/") {
+		if err := checkKey(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newNamespace makes a namespace that generates keys the way the store
+// does, but with a sequence of its own if the store uses one. The
+// caller must hold s.mu.
+func (s *URLStore) newNamespace(ns Namespace, pos uint64) {
+	n := &namespace{Namespace: ns, keys: s.keys}
+	if _, ok := s.keys.(sequencer); ok {
+		g := new(sequentialKeys)
+		g.Seek(pos)
+		n.keys = g
+	}
+	s.spaces[ns.Name] = n
+}
+
+// keysFor returns the key generator for namespace ns.
+func (s *URLStore) keysFor(ns string) (KeyGenerator, error) {
+	if ns == "" {
+		return s.keys, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n, ok := s.spaces[ns]
+	if !ok {
+		return nil, errNoNamespace
+	}
+	return n.keys, nil
+}
+
+// AddNamespace creates a namespace, returning it in created.
+func (s *URLStore) AddNamespace(ns *Namespace, created *Namespace) error {
+	if err := checkNamespace(ns.Name); err != nil {
+		return err
+	}
+	n := Namespace{Name: ns.Name, Owner: ns.Owner, Created: time.Now()}
+	s.order.Lock()
+	s.mu.Lock()
+	if _, ok := s.spaces[n.Name]; ok {
+		s.mu.Unlock()
+		s.order.Unlock()
+		return errNamespaceExists
+	}
+	s.newNamespace(n, 0)
+	s.mu.Unlock()
+	err := s.log(record{NS: &n}, func() {
+		s.mu.Lock()
+		delete(s.spaces, n.Name)
+		s.mu.Unlock()
+	})
+	if err != nil {
+		return err
+	}
+	*created = n
+	return nil
+}
+
+// DeleteNamespace removes an empty namespace, returning it in deleted.
+func (s *URLStore) DeleteNamespace(name *string, deleted *Namespace) error {
+	s.order.Lock()
+	s.mu.Lock()
+	n, ok := s.spaces[*name]
+	if !ok {
+		s.mu.Unlock()
+		s.order.Unlock()
+		return errNoNamespace
+	}
+	for k := range s.urls {
+		if ns, _ := splitKey(k); ns == *name {
+			s.mu.Unlock()
+			s.order.Unlock()
+			return errNamespaceInUse
+		}
+	}
+	delete(s.spaces, *name)
+	s.mu.Unlock()
+	err := s.log(record{NS: &n.Namespace, Deleted: true}, func() {
+		s.mu.Lock()
+		s.spaces[*name] = n
+		s.mu.Unlock()
+	})
+	if err != nil {
+		return err
+	}
+	*deleted = n.Namespace
+	return nil
+}
+
+// Namespaces lists the store's namespaces by name.
+func (s *URLStore) Namespaces(_ *int, list *[]Namespace) error {
+	s.mu.RLock()
+	for _, n := range s.spaces {
+		*list = append(*list, n.Namespace)
+	}
+	s.mu.RUnlock()
+	sort.Slice(*list, func(i, j int) bool { return (*list)[i].Name < (*list)[j].Name })
+	return nil
+}
+
+// List returns the full names of the keys in namespace ns, in order.
+// The empty namespace is the root.
+func (s *URLStore) List(ns *string, keys *[]string) error {
+	s.mu.RLock()
+	if _, ok := s.spaces[*ns]; !ok && *ns != "" {
+		s.mu.RUnlock()
+		return errNoNamespace
+	}
+	for k := range s.urls {
+		if n, _ := splitKey(k); n == *ns {
+			*keys = append(*keys, k)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(*keys)
+	return nil
+}
+
+// AddNamespace creates the namespace on every shard, since its keys
+// may land on any of them. A shard that already has it, as after an
+// earlier partial failure, is not an error unless all of them do.
+func (s *ProxyStore) AddNamespace(ns *Namespace, created *Namespace) error {
+	if s.ring == nil {
+		return remoteError(s.client.Call("Store.AddNamespace", ns, created))
+	}
+	existed := 0
+	for _, m := range s.shards {
+		var n Namespace
+		switch err := remoteError(m.Call("Store.AddNamespace", ns, &n)); err {
+		case nil:
+			*created = n
+		case errNamespaceExists:
+			existed++
+		default:
+			return err
+		}
+	}
+	if existed == len(s.shards) {
+		return errNamespaceExists
+	}
+	return nil
+}
+
+// DeleteNamespace removes the namespace from every shard. It fails if
+// the namespace is in use on any of them, checked before any is
+// removed, though a key added meanwhile can still leave it half gone.
+func (s *ProxyStore) DeleteNamespace(name *string, deleted *Namespace) error {
+	if s.ring == nil {
+		return remoteError(s.client.Call("Store.DeleteNamespace", name, deleted))
+	}
+	var keys []string
+	if err := s.List(name, &keys); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return errNamespaceInUse
+	}
+	found := false
+	for _, m := range s.shards {
+		var n Namespace
+		switch err := remoteError(m.Call("Store.DeleteNamespace", name, &n)); err {
+		case nil:
+			*deleted = n
+			found = true
+		case errNoNamespace:
+		default:
+			return err
+		}
+	}
+	if !found {
+		return errNoNamespace
+	}
+	return nil
+}
+
+func (s *ProxyStore) Namespaces(_ *int, list *[]Namespace) error {
+	return remoteError(s.client.Call("Store.Namespaces", new(int), list))
+}
+
+// List merges the keys from every shard.
+func (s *ProxyStore) List(ns *string, keys *[]string) error {
+	if s.ring == nil {
+		return remoteError(s.client.Call("Store.List", ns, keys))
+	}
+	missing := 0
+	for _, m := range s.shards {
+		var part []string
+		switch err := remoteError(m.Call("Store.List", ns, &part)); err {
+		case nil:
+			*keys = append(*keys, part...)
+		case errNoNamespace:
+			missing++
+		default:
+			return err
+		}
+	}
+	if missing == len(s.shards) {
+		return errNoNamespace
+	}
+	sort.Strings(*keys)
+	return nil
+}
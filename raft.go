@@ -0,0 +1,1169 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+// In replicated mode a set of goto nodes, the peers, keep the same
+// journal using the Raft consensus algorithm. One node at a time is
+// elected leader and takes all writes; it applies each to its store,
+// appends the record to its journal and sends it to the others, and
+// the write succeeds once a majority of nodes have the record. The
+// other nodes, followers, apply records once they are committed. If
+// the followers stop hearing from the leader they elect a new one.
+//
+// In this mode the data file holds the node's copy of the replicated
+// journal, whose records carry the term in which they were written,
+// and the node's vote is kept beside it. Once enough records have
+// been applied, the node saves the store as of the last of them to a
+// snapshot file, also beside it, and drops them from the journal. A
+// follower too far behind for the leader to have the records it lacks
+// is sent the leader's snapshot instead.
+
+const (
+	raftHeartbeat  = 50e6
+	raftElection   = 300e6 // least time without a leader before an election
+	raftTimeout    = 200e6 // how long to wait for a peer to answer
+	raftBatch      = 500   // most records sent to a follower at once
+	raftSnapBatch  = 10000 // most snapshot records sent at once
+	raftSnapWait   = 10e9  // how long to wait for a peer to take part of a snapshot
+	raftCommitWait = 5e9
+)
+
+var (
+	errNotLeader   = errors.New("not the leader")
+	errNoLeader    = errors.New("no leader elected")
+	errUncommitted = errors.New("write may not have been committed")
+)
+
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+// A VoteRequest asks a peer to vote for Candidate as leader for Term.
+// LastIndex and LastTerm describe the end of the candidate's journal;
+// peers whose journals are further along refuse.
+type VoteRequest struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type VoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+// An AppendRequest carries records from the leader to a follower, to
+// go after the record at PrevIndex, which was written in PrevTerm. It
+// also tells the follower how far the journal is committed. With no
+// records it serves as the leader's heartbeat.
+type AppendRequest struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Records   []record
+	Commit    uint64
+}
+
+// An AppendReply says whether the follower took the records. Last is
+// the index of the follower's last record, to help the leader find
+// where their journals agree.
+type AppendReply struct {
+	Term    uint64
+	Success bool
+	Last    uint64
+}
+
+// A SnapshotRequest carries part of the leader's snapshot, which holds
+// the journal up to Index, to a follower that is too far behind for the
+// leader to send it records. Offset is the position of Records in the
+// snapshot, and Done is set on the last part.
+type SnapshotRequest struct {
+	Term     uint64
+	Leader   string
+	Index    uint64
+	LastTerm uint64
+	Offset   int
+	Records  []record
+	Done     bool
+}
+
+type SnapshotReply struct {
+	Term uint64
+}
+
+// RaftStatus describes a node's view of the cluster.
+type RaftStatus struct {
+	Self, Leader, Role string
+	Term               uint64
+	Last, Commit       uint64
+}
+
+// A raftNode is one member of a replicated cluster.
+type raftNode struct {
+	self     string
+	peers    []*peer
+	store    *URLStore
+	filename string
+
+	snapMu sync.Mutex // held while the snapshot is read or replaced; taken before mu
+
+	mu       sync.Mutex
+	j        *journal
+	log      []record // log[i] has index base+i+1
+	base     uint64   // index of the last record in the snapshot
+	baseTerm uint64   // and its term
+	install  []record // the parts of a snapshot received so far
+	state    int
+	term     uint64
+	votedFor string
+	leader   string
+	heard    time.Time     // when the leader or a candidate was last heard from
+	timeout  time.Duration // the election timeout, chosen at random
+	commit   uint64        // index of the last committed record
+	applied  uint64        // index of the last record applied to the store
+	ready    uint64        // index of the last record the store and its key sequence reflect
+	ledTerm  uint64        // term in which this node leads; its own records are applied already
+	noop     uint64        // index of the empty record that began the node's term as leader
+	dirty    bool          // the store may disagree with the journal
+	closed   bool
+	wake     chan bool // closed when the journal or the node's state changes
+}
+
+// A peer is another node, with the leader's view of how much of the
+// journal it has.
+type peer struct {
+	addr  string
+	next  uint64 // index of the next record to send it; guarded by raftNode.mu
+	match uint64 // index of the last record it is known to have
+
+	mu     sync.Mutex // held during calls
+	client *rpc.Client
+}
+
+// call invokes method on p, giving up after timeout.
+func (p *peer) call(method string, args, reply interface{}, timeout time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == nil {
+		c, err := dialHTTP(p.addr, raftTimeout)
+		if err != nil {
+			return err
+		}
+		p.client = c
+	}
+	call := p.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-t.C:
+		err = errCallTimeout
+	}
+	if _, ok := err.(rpc.ServerError); !ok && err != nil {
+		p.client.Close()
+		p.client = nil
+	}
+	return err
+}
+
+// newRaftNode returns the node self of the cluster formed by peers,
+// keeping its journal in filename and applying it to store.
+func newRaftNode(self string, peers []string, filename string, store *URLStore) (*raftNode, error) {
+	n := &raftNode{
+		self:     self,
+		store:    store,
+		filename: filename,
+		wake:     make(chan bool),
+		heard:    time.Now(),
+		timeout:  electionTimeout(),
+	}
+	for _, addr := range peers {
+		if addr != self {
+			n.peers = append(n.peers, &peer{addr: addr})
+		}
+	}
+	if len(n.peers) == len(peers) {
+		return nil, errors.New("this node is not among the peers")
+	}
+	if err := n.loadVote(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var next uint64
+	var err error
+	n.base, n.baseTerm, err = n.loadSnapshot(store, &next)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, err = readJournal(filename, true, func(seq uint64, r record) {
+		// Skip what the snapshot holds, and anything left from
+		// before a snapshot was installed that does not follow on
+		// from it; terms never go down along a journal.
+		if seq == n.lastIndex()+1 && r.Term >= n.termAt(n.lastIndex()) {
+			n.log = append(n.log, r)
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if n.j, err = openJournal(filename, n.lastIndex()); err != nil {
+		return nil, err
+	}
+	n.commit, n.applied, n.ready = n.base, n.base, n.base
+	n.seek(next)
+	store.raft = n
+	store.feed.start(n.base)
+	go n.electionLoop()
+	go n.applyLoop()
+	return n, nil
+}
+
+func electionTimeout() time.Duration {
+	return raftElection + time.Duration(rand.Int63n(raftElection))
+}
+
+func (n *raftNode) lastIndex() uint64 {
+	return n.base + uint64(len(n.log))
+}
+
+// termAt returns the term of the record at index i, or zero if there
+// is none or it is in the snapshot, save for the last.
+func (n *raftNode) termAt(i uint64) uint64 {
+	switch {
+	case i == n.base:
+		return n.baseTerm
+	case i < n.base || i > n.lastIndex():
+		return 0
+	}
+	return n.log[i-n.base-1].Term
+}
+
+// entries returns a copy of the records from index i to j inclusive.
+// The caller must hold n.mu.
+func (n *raftNode) entries(i, j uint64) []record {
+	return append([]record(nil), n.log[i-n.base-1:j-n.base]...)
+}
+
+// signal wakes everything waiting for the node to change. The caller
+// must hold n.mu.
+func (n *raftNode) signal() {
+	close(n.wake)
+	n.wake = make(chan bool)
+}
+
+// vote is the state a node must remember across restarts.
+type vote struct {
+	Term     uint64
+	VotedFor string
+}
+
+func (n *raftNode) loadVote() error {
+	b, err := os.ReadFile(n.filename + ".vote")
+	if err != nil {
+		return err
+	}
+	var v vote
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	n.term, n.votedFor = v.Term, v.VotedFor
+	return nil
+}
+
+// saveVote records the node's term and vote. The caller must hold
+// n.mu.
+func (n *raftNode) saveVote() error {
+	b, err := json.Marshal(vote{n.term, n.votedFor})
+	if err != nil {
+		return err
+	}
+	tmp := n.filename + ".vote.tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, n.filename+".vote")
+	}
+	return err
+}
+
+// append adds rs to the end of the journal. The caller must hold n.mu.
+func (n *raftNode) append(rs ...record) error {
+	if n.closed {
+		return errClosed
+	}
+	for _, r := range rs {
+		if err := n.j.append(r); err != nil {
+			return err
+		}
+		n.log = append(n.log, r)
+	}
+	var err error
+	if syncEvery == syncNone {
+		err = n.j.flush()
+	} else {
+		err = n.j.sync()
+	}
+	n.signal()
+	return err
+}
+
+// truncate cuts the journal back to index k. The caller must hold
+// n.mu.
+func (n *raftNode) truncate(k uint64) error {
+	n.log = n.log[:k-n.base]
+	return n.rewrite()
+}
+
+// rewrite replaces the data file with the records in n.log. The caller
+// must hold n.mu.
+func (n *raftNode) rewrite() error {
+	tmp, err := os.Create(n.filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(tmp)
+	for i, r := range n.log {
+		if err = writeRecord(b, n.base+uint64(i+1), r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = b.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		n.j.close()
+		err = os.Rename(n.filename+".tmp", n.filename)
+	}
+	if err != nil {
+		os.Remove(n.filename + ".tmp")
+		return err
+	}
+	n.j, err = openJournal(n.filename, n.lastIndex())
+	return err
+}
+
+// stepDown makes the node a follower, in term if that is later than
+// its own. The caller must hold n.mu.
+func (n *raftNode) stepDown(term uint64) {
+	if term > n.term {
+		n.term, n.votedFor, n.leader = term, "", ""
+		if err := n.saveVote(); err != nil {
+			log.Println("raft:", err)
+		}
+	}
+	if n.state == leader {
+		log.Printf("raft: %s stepping down in term %d", n.self, n.term)
+		// Writes made while leading that never committed may
+		// still be in the store.
+		n.ledTerm = 0
+		n.dirty = true
+	}
+	n.state = follower
+	n.signal()
+}
+
+func (n *raftNode) electionLoop() {
+	for {
+		time.Sleep(raftHeartbeat)
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			return
+		}
+		if n.state != leader && time.Since(n.heard) > n.timeout {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection makes the node a candidate in a new term and asks the
+// other nodes for their votes. The caller must hold n.mu.
+func (n *raftNode) startElection() {
+	n.term++
+	n.state, n.votedFor, n.leader = candidate, n.self, ""
+	n.heard, n.timeout = time.Now(), electionTimeout()
+	if err := n.saveVote(); err != nil {
+		log.Println("raft:", err)
+		return
+	}
+	req := VoteRequest{n.term, n.self, n.lastIndex(), n.termAt(n.lastIndex())}
+	votes := 1
+	if n.majority(votes) {
+		n.becomeLeader()
+		return
+	}
+	for _, p := range n.peers {
+		go func(p *peer) {
+			var rep VoteReply
+			if err := p.call("Raft.RequestVote", &req, &rep, raftTimeout); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if rep.Term > n.term {
+				n.stepDown(rep.Term)
+				return
+			}
+			if n.state != candidate || n.term != req.Term || !rep.Granted {
+				return
+			}
+			if votes++; n.majority(votes) {
+				n.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+// majority reports whether votes nodes are a majority of the cluster.
+func (n *raftNode) majority(votes int) bool {
+	return votes*2 > len(n.peers)+1
+}
+
+// becomeLeader takes over as leader. It starts the term with an empty
+// record, as committing that commits everything before it; the node
+// takes no writes until it has applied that record, so that its store
+// holds every earlier write and its key sequence is past their keys.
+// The caller must hold n.mu.
+func (n *raftNode) becomeLeader() {
+	log.Printf("raft: %s leading in term %d", n.self, n.term)
+	n.state, n.leader, n.ledTerm = leader, n.self, n.term
+	for _, p := range n.peers {
+		p.next, p.match = n.lastIndex()+1, 0
+	}
+	if err := n.append(record{Term: n.term}); err != nil {
+		log.Println("raft:", err)
+	}
+	n.noop = n.lastIndex()
+	n.advanceCommit()
+	for _, p := range n.peers {
+		go n.replicateLoop(p, n.term)
+	}
+}
+
+// replicateLoop keeps p up to date with the journal for as long as
+// the node leads in term.
+func (n *raftNode) replicateLoop(p *peer, term uint64) {
+	for {
+		n.mu.Lock()
+		if n.closed || n.state != leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		if p.next <= n.base {
+			n.mu.Unlock()
+			n.catchUp(p, term)
+			continue
+		}
+		prev := p.next - 1
+		req := AppendRequest{
+			Term:      term,
+			Leader:    n.self,
+			PrevIndex: prev,
+			PrevTerm:  n.termAt(prev),
+			Commit:    n.commit,
+		}
+		end := n.lastIndex()
+		if end-prev > raftBatch {
+			end = prev + raftBatch
+		}
+		req.Records = n.entries(prev+1, end)
+		wake := n.wake
+		n.mu.Unlock()
+
+		var rep AppendReply
+		err := p.call("Raft.AppendEntries", &req, &rep, raftTimeout)
+		n.mu.Lock()
+		more := false
+		switch {
+		case err != nil:
+		case rep.Term > n.term:
+			n.stepDown(rep.Term)
+		case n.state != leader || n.term != term:
+		case rep.Success:
+			p.match = prev + uint64(len(req.Records))
+			p.next = p.match + 1
+			n.advanceCommit()
+			more = p.next <= n.lastIndex()
+		default:
+			// Back up to where the journals might agree.
+			p.next = prev
+			if rep.Last < prev {
+				p.next = rep.Last + 1
+			}
+			if p.next < 1 {
+				p.next = 1
+			}
+			more = true
+		}
+		n.mu.Unlock()
+		if !more {
+			t := time.NewTimer(raftHeartbeat)
+			select {
+			case <-wake:
+			case <-t.C:
+			}
+			t.Stop()
+		}
+	}
+}
+
+// catchUp sends p the snapshot, for when it lacks records that the
+// node no longer has. It first sends an empty part, so as not to read
+// the snapshot for a peer that is down.
+func (n *raftNode) catchUp(p *peer, term uint64) {
+	req := SnapshotRequest{Term: term, Leader: n.self}
+	var rs []record
+	err := n.sendPart(p, &req)
+	if err == nil {
+		n.snapMu.Lock()
+		n.mu.Lock()
+		req.Index, req.LastTerm = n.base, n.baseTerm
+		n.mu.Unlock()
+		_, err = readJournal(snapshotName(n.filename), false, func(_ uint64, r record) {
+			rs = append(rs, r)
+		})
+		n.snapMu.Unlock()
+	}
+	if err == nil {
+		log.Printf("raft: %s sending %s a snapshot of %d records", n.self, p.addr, len(rs))
+	}
+	for err == nil && !req.Done {
+		end := req.Offset + raftSnapBatch
+		if end > len(rs) {
+			end = len(rs)
+		}
+		req.Records, req.Done = rs[req.Offset:end], end == len(rs)
+		err = n.sendPart(p, &req)
+		req.Offset = end
+	}
+	if err != nil {
+		if err != errNotLeader {
+			time.Sleep(raftHeartbeat)
+		}
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state == leader && n.term == term && p.match < req.Index {
+		p.match, p.next = req.Index, req.Index+1
+		n.advanceCommit()
+	}
+}
+
+// sendPart sends p a part of the snapshot, returning errNotLeader if p
+// knows of a later term.
+func (n *raftNode) sendPart(p *peer, req *SnapshotRequest) error {
+	var rep SnapshotReply
+	if err := p.call("Raft.InstallSnapshot", req, &rep, raftSnapWait); err != nil {
+		return err
+	}
+	if rep.Term > req.Term {
+		n.mu.Lock()
+		if rep.Term > n.term {
+			n.stepDown(rep.Term)
+		}
+		n.mu.Unlock()
+		return errNotLeader
+	}
+	return nil
+}
+
+// advanceCommit commits the latest record from the current term that
+// a majority of nodes have. The caller must hold n.mu.
+func (n *raftNode) advanceCommit() {
+	for i := n.lastIndex(); i > n.commit && n.termAt(i) == n.term; i-- {
+		votes := 1
+		for _, p := range n.peers {
+			if p.match >= i {
+				votes++
+			}
+		}
+		if n.majority(votes) {
+			n.commit = i
+			n.signal()
+			return
+		}
+	}
+}
+
+// RequestVote is called by a candidate to ask for the node's vote.
+func (n *raftNode) RequestVote(req *VoteRequest, rep *VoteReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	rep.Term = n.term
+	if req.Term < n.term {
+		return nil
+	}
+	last := n.lastIndex()
+	upToDate := req.LastTerm > n.termAt(last) ||
+		req.LastTerm == n.termAt(last) && req.LastIndex >= last
+	if upToDate && (n.votedFor == "" || n.votedFor == req.Candidate) {
+		n.votedFor = req.Candidate
+		if err := n.saveVote(); err != nil {
+			return err
+		}
+		n.heard = time.Now()
+		rep.Granted = true
+	}
+	return nil
+}
+
+// AppendEntries is called by the leader to send records and
+// heartbeats.
+func (n *raftNode) AppendEntries(req *AppendRequest, rep *AppendReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term || req.Term == n.term && n.state != follower {
+		n.stepDown(req.Term)
+	}
+	rep.Term = n.term
+	if req.Term < n.term {
+		return nil
+	}
+	if n.leader != req.Leader {
+		log.Printf("raft: %s following %s in term %d", n.self, req.Leader, n.term)
+		n.leader = req.Leader
+	}
+	n.heard = time.Now()
+	rep.Last = n.lastIndex()
+	if req.PrevIndex > n.lastIndex() {
+		return nil
+	}
+	if req.PrevIndex < n.base {
+		// The records in the snapshot are committed, so the
+		// leader's agree with them.
+		skip := n.base - req.PrevIndex
+		if skip > uint64(len(req.Records)) {
+			skip = uint64(len(req.Records))
+		}
+		req.Records = req.Records[skip:]
+		req.PrevIndex += skip
+		req.PrevTerm = n.termAt(req.PrevIndex)
+	}
+	if n.termAt(req.PrevIndex) != req.PrevTerm {
+		rep.Last = req.PrevIndex - 1
+		return nil
+	}
+	for i, r := range req.Records {
+		idx := req.PrevIndex + uint64(i) + 1
+		if idx <= n.lastIndex() {
+			if n.termAt(idx) == r.Term {
+				continue
+			}
+			if err := n.truncate(idx - 1); err != nil {
+				return err
+			}
+		}
+		if err := n.append(req.Records[i:]...); err != nil {
+			return err
+		}
+		break
+	}
+	rep.Success = true
+	rep.Last = n.lastIndex()
+	last := req.PrevIndex + uint64(len(req.Records))
+	if req.Commit < last {
+		last = req.Commit
+	}
+	if last > n.commit {
+		n.commit = last
+		n.signal()
+	}
+	return nil
+}
+
+// InstallSnapshot is called by the leader to send its snapshot, in
+// parts, to a follower that is too far behind to be sent records.
+func (n *raftNode) InstallSnapshot(req *SnapshotRequest, rep *SnapshotReply) error {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+	n.mu.Lock()
+	if req.Term > n.term || req.Term == n.term && n.state != follower {
+		n.stepDown(req.Term)
+	}
+	rep.Term = n.term
+	if req.Term < n.term {
+		n.mu.Unlock()
+		return nil
+	}
+	n.leader, n.heard = req.Leader, time.Now()
+	if req.Offset == 0 {
+		n.install = nil
+	}
+	if req.Offset != len(n.install) {
+		n.mu.Unlock()
+		return errors.New("snapshot part out of order")
+	}
+	n.install = append(n.install, req.Records...)
+	rs := n.install
+	if !req.Done || req.Index <= n.commit {
+		if req.Done {
+			n.install = nil
+		}
+		n.mu.Unlock()
+		return nil
+	}
+	n.install = nil
+	n.mu.Unlock()
+
+	log.Printf("raft: %s installing a snapshot of %d records from %s", n.self, len(rs), req.Leader)
+	if err := writeSnapshot(snapshotName(n.filename), req.Index, rs); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.termAt(req.Index) == req.LastTerm {
+		n.log = append([]record(nil), n.log[req.Index-n.base:]...)
+	} else {
+		n.log = nil
+	}
+	n.base, n.baseTerm = req.Index, req.LastTerm
+	if n.commit < req.Index {
+		n.commit = req.Index
+	}
+	n.dirty = true
+	n.signal()
+	return n.rewrite()
+}
+
+// propose appends r, which the store has already applied, to the
+// journal, and returns a function that waits for it to be committed.
+// If that cannot tell whether r was committed, r stays in the journal
+// and may commit later, so it has the store rebuilt from the journal
+// rather than have the caller undo the write.
+func (n *raftNode) propose(r record) (wait func() error, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != leader {
+		n.dirty = true
+		return nil, errNotLeader
+	}
+	r.Term = n.term
+	if err := n.append(r); err != nil {
+		n.dirty = true
+		return nil, err
+	}
+	index, term := n.lastIndex(), n.term
+	n.advanceCommit() // in case the node is alone
+	return func() error { return n.awaitCommit(index, term) }, nil
+}
+
+// awaitCommit waits for the record at index, appended as leader in
+// term, to be committed.
+func (n *raftNode) awaitCommit(index, term uint64) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	deadline := time.NewTimer(raftCommitWait)
+	defer deadline.Stop()
+	for n.commit < index {
+		if n.term != term || n.state != leader {
+			return n.uncommitted()
+		}
+		wake := n.wake
+		n.mu.Unlock()
+		select {
+		case <-wake:
+		case <-deadline.C:
+			n.mu.Lock()
+			return n.uncommitted()
+		}
+		n.mu.Lock()
+	}
+	if index > n.base && n.termAt(index) != term {
+		return n.uncommitted()
+	}
+	return nil
+}
+
+// uncommitted marks the store for rebuilding and returns
+// errUncommitted. The caller must hold n.mu.
+func (n *raftNode) uncommitted() error {
+	n.dirty = true
+	n.signal()
+	return errUncommitted
+}
+
+// applyLoop applies committed records to the store, and rebuilds the
+// store from the journal when it may have gone astray.
+func (n *raftNode) applyLoop() {
+	var next uint64
+	for {
+		n.mu.Lock()
+		for !n.closed && !n.dirty && n.applied >= n.commit {
+			wake := n.wake
+			n.mu.Unlock()
+			<-wake
+			n.mu.Lock()
+		}
+		if n.closed {
+			n.mu.Unlock()
+			return
+		}
+		if n.dirty {
+			n.mu.Unlock()
+			n.rebuild(&next)
+			continue
+		}
+		from, to, base, led := n.applied, n.commit, n.base, n.ledTerm
+		rs := n.entries(from+1, to)
+		n.applied = to
+		n.mu.Unlock()
+		for i, r := range rs {
+			seq := from + uint64(i) + 1
+			if r.Term != led {
+				n.store.replay(seq, r, &next)
+			}
+			n.store.feed.publish(seq, r)
+		}
+		n.seek(next)
+		n.setReady(to)
+		if *compactMax > 0 && to-base >= uint64(*compactMax) {
+			if err := n.compact(to); err != nil {
+				log.Println("raft:", err)
+			}
+		}
+	}
+}
+
+// rebuild replaces the store's contents with the snapshot and the
+// journal after it: the committed records, or all of them on the
+// leader, whose own writes are in the store before they are committed.
+func (n *raftNode) rebuild(next *uint64) {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+	n.mu.Lock()
+	end := n.commit
+	if n.state == leader {
+		end = n.lastIndex()
+	}
+	from, to, base := n.applied, n.commit, n.base
+	rs := n.entries(base+1, end)
+	n.applied, n.dirty = n.commit, false
+	n.ready = 0 // no writes until the new contents are in place
+	n.mu.Unlock()
+	log.Printf("raft: %s rebuilding store from %d records", n.self, len(rs))
+	// Build the new contents aside, so that readers are not left
+	// with an empty store meanwhile.
+	t := newStore(n.store.keys)
+	if _, _, err := n.loadSnapshot(t, next); err != nil && !os.IsNotExist(err) {
+		log.Println("raft:", err)
+	}
+	for i, r := range rs {
+		t.replay(base+uint64(i)+1, r, next)
+	}
+	n.store.swap(t)
+	// Writes the leader took while the new contents were being
+	// built went to the old ones.
+	n.mu.Lock()
+	var late []record
+	if n.state == leader && n.lastIndex() > end {
+		late = n.entries(end+1, n.lastIndex())
+	}
+	n.mu.Unlock()
+	for i, r := range late {
+		n.store.replay(end+uint64(i)+1, r, next)
+	}
+	end += uint64(len(late))
+	if from < base {
+		// The records in between came in a snapshot, so slaves
+		// following the node must start again from one.
+		n.store.feed.start(base)
+		from = base
+	}
+	for i := from; i < to; i++ {
+		n.store.feed.publish(i+1, rs[i-base])
+	}
+	n.seek(*next)
+	n.setReady(end)
+}
+
+// loadSnapshot replays the snapshot into s, returning the index and
+// term of the last record it holds.
+func (n *raftNode) loadSnapshot(s *URLStore, next *uint64) (index, term uint64, err error) {
+	_, err = readJournal(snapshotName(n.filename), false, func(seq uint64, r record) {
+		index = seq
+		if r.Term != 0 {
+			term = r.Term
+		}
+		s.replay(seq, r, next)
+	})
+	return index, term, err
+}
+
+// compact saves the journal up to index i, which must be committed, to
+// the snapshot and drops it from memory and from the data file. On the
+// leader the store may hold writes not yet committed, so the snapshot
+// is made by replaying those records on top of the last one instead.
+func (n *raftNode) compact(i uint64) error {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+	n.mu.Lock()
+	base, term := n.base, n.termAt(i)
+	if i <= base {
+		n.mu.Unlock()
+		return nil
+	}
+	rs := n.entries(base+1, i)
+	n.mu.Unlock()
+
+	// A sequencer keeps the key sequences' positions.
+	g := new(sequentialKeys)
+	s := newStore(g)
+	var next uint64
+	if _, _, err := n.loadSnapshot(s, &next); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for k, r := range rs {
+		s.replay(base+uint64(k)+1, r, &next)
+	}
+	g.Seek(next)
+	snap := append([]record{{Term: term}}, s.records()...)
+	if err := writeSnapshot(snapshotName(n.filename), i, snap); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.log = append([]record(nil), n.log[i-base:]...)
+	n.base, n.baseTerm = i, term
+	log.Printf("raft: %s compacted journal to %d", n.self, i)
+	return n.rewrite()
+}
+
+// setReady notes that the store reflects the journal up to index i,
+// unless it has gone astray again since.
+func (n *raftNode) setReady(i uint64) {
+	n.mu.Lock()
+	if !n.dirty {
+		n.ready = i
+	}
+	n.mu.Unlock()
+}
+
+// seek moves the store's key sequence on to next, if need be, so that
+// a node that becomes leader does not reuse keys.
+func (n *raftNode) seek(next uint64) {
+	if g, ok := n.store.keys.(sequencer); ok {
+		g.Seek(next)
+	}
+}
+
+// leading returns errNotLeader unless the node leads and has caught
+// its store up with the journal it inherited.
+func (n *raftNode) leading() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != leader || n.dirty || n.ready < n.noop {
+		return errNotLeader
+	}
+	return nil
+}
+
+func (n *raftNode) Status() RaftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st := RaftStatus{
+		Self:   n.self,
+		Leader: n.leader,
+		Role:   []string{"follower", "candidate", "leader"}[n.state],
+		Term:   n.term,
+		Last:   n.lastIndex(),
+		Commit: n.commit,
+	}
+	return st
+}
+
+func (n *raftNode) close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil
+	}
+	n.closed = true
+	n.signal()
+	return n.j.close()
+}
+
+// swap replaces the store's contents with t's, keeping its key
+// generator. As any key may have changed, callers of Changed are told
+// to start again.
+func (s *URLStore) swap(t *URLStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.urls, s.history, s.expires = t.urls, t.history, t.expires
+	s.spaces, s.byURL, s.folded = t.spaces, t.byURL, t.folded
+	s.chgBase += len(s.changed) + 1
+	s.changed = nil
+}
+
+// A RaftStore is a URLStore replicated across a cluster of nodes. Only
+// the leader accepts writes; the other nodes answer errNotLeader, and
+// Leader tells callers where to go instead.
+type RaftStore struct {
+	*URLStore
+	node *raftNode
+}
+
+// NewRaftStore returns the store for node self of the cluster formed
+// by peers, keeping its journal in filename.
+func NewRaftStore(self string, peers []string, filename string, keys KeyGenerator) (*RaftStore, error) {
+	s := newStore(keys)
+	n, err := newRaftNode(self, peers, filename, s)
+	if err != nil {
+		return nil, err
+	}
+	go s.reapLoop()
+	return &RaftStore{s, n}, nil
+}
+
+// Leader returns the address of the current leader, if known.
+func (s *RaftStore) Leader(_ *int, addr *string) error {
+	*addr = s.node.Status().Leader
+	return nil
+}
+
+func (s *RaftStore) Status() RaftStatus {
+	return s.node.Status()
+}
+
+func (s *RaftStore) Health() error {
+	if s.node.Status().Leader == "" {
+		return errNoLeader
+	}
+	return s.URLStore.Health()
+}
+
+func (s *RaftStore) Close() error {
+	return s.node.close()
+}
+
+func (s *RaftStore) Put(url, key *string) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.Put(url, key)
+}
+
+func (s *RaftStore) PutLink(l *Link, key *string) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.PutLink(l, key)
+}
+
+func (s *RaftStore) PutCustom(c *CustomLink, key *string) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.PutCustom(c, key)
+}
+
+func (s *RaftStore) PutMulti(links *[]CustomLink, rs *[]Result) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.PutMulti(links, rs)
+}
+
+func (s *RaftStore) Import(links *[]CustomLink, rs *[]Result) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.Import(links, rs)
+}
+
+func (s *RaftStore) Delete(key, url *string) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.Delete(key, url)
+}
+
+func (s *RaftStore) Update(e *Edit, url *string) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.Update(e, url)
+}
+
+func (s *RaftStore) Rollback(r *Rollback, url *string) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.Rollback(r, url)
+}
+
+func (s *RaftStore) AddNamespace(ns *Namespace, created *Namespace) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.AddNamespace(ns, created)
+}
+
+func (s *RaftStore) DeleteNamespace(name *string, deleted *Namespace) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.DeleteNamespace(name, deleted)
+}
+
+func (s *RaftStore) Lease(n *uint64, l *KeyLease) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.Lease(n, l)
+}
+
+func (s *RaftStore) Replicate(links *[]CustomLink, n *int) error {
+	if err := s.node.leading(); err != nil {
+		return err
+	}
+	return s.URLStore.Replicate(links, n)
+}
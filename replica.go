@@ -0,0 +1,432 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	feedKept        = 10000 // journal records the master keeps for slaves to follow
+	followWait      = 5e9   // how long Follow waits for new records
+	followBatch     = 1000
+	followSnapBatch = 10000 // most snapshot records sent at once
+)
+
+// A Follow asks for the master's journal after Seq, as the caller had
+// it from the run of the master identified by Epoch. If Offset is set,
+// the caller is instead part way through the snapshot taken at Epoch
+// and Seq, and asks for its records from Offset on.
+type Follow struct {
+	Epoch  int64
+	Seq    uint64
+	Offset int
+}
+
+// A Feed is a piece of the master's journal, up to and including
+// sequence number Seq. If Reset is set, Records are instead part of a
+// snapshot of the whole store, taken at Seq or later, to replace what
+// the caller has once it has every part. Offset is the position of
+// Records in the snapshot, and Done is set on the last part.
+type Feed struct {
+	Epoch   int64
+	Seq     uint64
+	Records []record
+	Reset   bool
+	Offset  int
+	Done    bool
+}
+
+// feed keeps the records most recently written to a store's journal,
+// so that slaves can follow it without the master rereading the file.
+type feed struct {
+	mu      sync.Mutex
+	epoch   int64  // identifies this run of the master
+	loaded  uint64 // sequence number of the last record loaded at startup
+	base    uint64 // sequence number of the record before records[0]
+	records []record
+	wake    chan bool // closed when records arrive
+	snap    *Feed     // the last snapshot taken for followers, whole
+}
+
+// start begins a new run of the feed after seq, dropping any records
+// kept, so that followers from before start again from a snapshot.
+func (f *feed) start(seq uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.wake != nil {
+		close(f.wake)
+	}
+	f.epoch = time.Now().UnixNano()
+	f.loaded, f.base = seq, seq
+	f.records = nil
+	f.wake = make(chan bool)
+}
+
+// publish adds r, which was just written to the journal as seq.
+func (f *feed) publish(seq uint64, r record) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records = append(f.records, r)
+	if len(f.records) >= 2*feedKept {
+		n := len(f.records) - feedKept
+		f.records = append([]record(nil), f.records[n:]...)
+		f.base += uint64(n)
+	}
+	close(f.wake)
+	f.wake = make(chan bool)
+}
+
+// read fills fd with the records following fl and reports whether it
+// could. It cannot if fl is from an earlier run of the master and goes
+// beyond what that run left on disk, or if fl is outside the records
+// kept. The returned channel is closed when more records arrive.
+func (f *feed) read(fl *Follow, fd *Feed) (ok bool, wake chan bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.base + uint64(len(f.records))
+	if fl.Epoch != f.epoch && fl.Seq > f.loaded || fl.Seq < f.base || fl.Seq > end {
+		return false, nil
+	}
+	rs := f.records[fl.Seq-f.base:]
+	if len(rs) > followBatch {
+		rs = rs[:followBatch]
+	}
+	fd.Epoch = f.epoch
+	fd.Seq = fl.Seq + uint64(len(rs))
+	fd.Records = append([]record(nil), rs...)
+	return true, f.wake
+}
+
+// started reports whether the feed has been started, as it is for
+// stores with a journal.
+func (f *feed) started() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.wake != nil
+}
+
+// snapshot returns the last snapshot taken for followers, if the
+// caller at fl may have it: if fl is part way through it, or if it can
+// still be followed on from.
+func (f *feed) snapshot(fl *Follow) *Feed {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sn := f.snap
+	switch {
+	case sn == nil:
+		return nil
+	case fl.Offset > 0 && fl.Epoch == sn.Epoch && fl.Seq == sn.Seq:
+		return sn
+	case sn.Epoch == f.epoch && sn.Seq >= f.base:
+		return sn
+	}
+	return nil
+}
+
+// keep saves sn as the snapshot for followers to fetch in parts.
+func (f *feed) keep(sn *Feed) {
+	f.mu.Lock()
+	f.snap = sn
+	f.mu.Unlock()
+}
+
+// position returns the master's epoch and the sequence number of the
+// last record published.
+func (f *feed) position() (int64, uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.epoch, f.base + uint64(len(f.records))
+}
+
+// Follow returns the records written to the store's journal after
+// fl.Seq, waiting a while for some if there are none yet. If the
+// caller is too far behind, or cannot be sure that its records match
+// the store's, it is sent a snapshot instead.
+func (s *URLStore) Follow(fl *Follow, fd *Feed) error {
+	defer statSend("store follow")
+	if !s.feed.started() {
+		return errors.New("store has no journal to follow")
+	}
+	if fl.Offset > 0 {
+		s.followSnapshot(fl, fd)
+		return nil
+	}
+	ok, wake := s.feed.read(fl, fd)
+	if ok && len(fd.Records) == 0 {
+		select {
+		case <-wake:
+			ok, _ = s.feed.read(fl, fd)
+		case <-time.After(followWait):
+		}
+	}
+	if !ok {
+		s.followSnapshot(fl, fd)
+	}
+	return nil
+}
+
+// followSnapshot fills fd with the part of a snapshot that fl asks for,
+// or the first part of one if fl is not part way through it. The store
+// is copied for a snapshot only when the last one taken can no longer
+// be followed on from, so that followers fetching its parts, or
+// retrying, do not copy it again.
+func (s *URLStore) followSnapshot(fl *Follow, fd *Feed) {
+	sn := s.feed.snapshot(fl)
+	if sn == nil {
+		// Every record published so far has been applied, so the
+		// snapshot covers them; any it also covers beyond those
+		// are harmless to replay.
+		sn = &Feed{Reset: true}
+		sn.Epoch, sn.Seq = s.feed.position()
+		sn.Records = s.records()
+		s.feed.keep(sn)
+		statSend("store follow snapshot")
+	}
+	off := fl.Offset
+	if fl.Epoch != sn.Epoch || fl.Seq != sn.Seq || off > len(sn.Records) {
+		off = 0
+	}
+	end := off + followSnapBatch
+	if end > len(sn.Records) {
+		end = len(sn.Records)
+	}
+	*fd = Feed{Epoch: sn.Epoch, Seq: sn.Seq, Records: sn.Records[off:end], Reset: true, Offset: off, Done: end == len(sn.Records)}
+}
+
+// A replica is a slave's copy of all the master's links, kept up to
+// date by following the master's journal. It is saved to a journal of
+// its own that carries the master's sequence numbers, so that the
+// slave can resume where it left off after a restart.
+type replica struct {
+	filename string
+	mu       sync.RWMutex // guards urls, which reset replaces, and seq
+	urls     *URLStore
+	seq      uint64 // of the last record applied, for Status
+	j        *journal
+	epoch    int64 // the master's, as of the last record received
+	logged   int   // records in the journal since the last snapshot
+	install  *Feed // the parts of a snapshot received so far
+}
+
+func openReplica(filename string) (*replica, error) {
+	rp := &replica{filename: filename, urls: newStore(nil)}
+	var next uint64
+	load := func(seq uint64, r record) {
+		if r.Epoch != 0 {
+			rp.epoch = r.Epoch
+		}
+		rp.urls.replay(seq, r, &next)
+	}
+	_, err := readJournal(snapshotName(filename), false, load)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Replaying is harmless to repeat, so unlike URLStore.load this
+	// need not skip records the snapshot covers.
+	rp.logged, err = readJournal(filename, true, load)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	rp.seq = rp.urls.seq
+	if rp.j, err = openJournal(filename, rp.seq); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// get returns the link for key, or errNotCached if the replica does
+// not have it yet.
+func (rp *replica) get(key string) (Link, error) {
+	rp.mu.RLock()
+	urls := rp.urls
+	rp.mu.RUnlock()
+	var l Link
+	err := urls.GetLink(&key, &l)
+	if err == errNotFound {
+		err = errNotCached
+	}
+	return l, err
+}
+
+// position returns what to ask the master for next.
+func (rp *replica) position() Follow {
+	if in := rp.install; in != nil {
+		return Follow{Epoch: in.Epoch, Seq: in.Seq, Offset: len(in.Records)}
+	}
+	return Follow{Epoch: rp.epoch, Seq: rp.j.seq}
+}
+
+// Status returns the number of links in the replica and the
+// sequence number of the last record applied.
+func (rp *replica) Status() (links int, seq uint64) {
+	rp.mu.RLock()
+	urls, seq := rp.urls, rp.seq
+	rp.mu.RUnlock()
+	urls.mu.RLock()
+	defer urls.mu.RUnlock()
+	return len(urls.urls), seq
+}
+
+// apply saves fd to the replica's journal and applies it, or holds on
+// to it if it is part of a snapshot still to be completed.
+func (rp *replica) apply(fd *Feed) error {
+	if fd.Reset {
+		in := rp.install
+		if fd.Offset == 0 || in == nil || in.Epoch != fd.Epoch || in.Seq != fd.Seq || fd.Offset != len(in.Records) {
+			in = &Feed{Epoch: fd.Epoch, Seq: fd.Seq, Reset: true}
+			if fd.Offset != 0 {
+				rp.install = nil
+				return errors.New("snapshot part out of order")
+			}
+		}
+		in.Records = append(in.Records, fd.Records...)
+		if !fd.Done {
+			rp.install = in
+			return nil
+		}
+		rp.install = nil
+		return rp.reset(in)
+	}
+	rp.install = nil
+	if fd.Epoch != rp.epoch {
+		// Note the master's new epoch without using up a
+		// sequence number.
+		if err := writeRecord(rp.j.b, rp.j.seq, record{Epoch: fd.Epoch}); err != nil {
+			return err
+		}
+		rp.epoch = fd.Epoch
+	}
+	var next uint64
+	for _, r := range fd.Records {
+		if err := rp.j.append(r); err != nil {
+			return err
+		}
+		rp.urls.replay(rp.j.seq, r, &next)
+		rp.logged++
+	}
+	if err := rp.j.flush(); err != nil {
+		return err
+	}
+	rp.mu.Lock()
+	rp.seq = rp.j.seq
+	rp.mu.Unlock()
+	if rp.j.seq != fd.Seq {
+		rp.epoch = 0 // start again from a snapshot
+		return errors.New("replica out of step with master")
+	}
+	if *compactMax > 0 && rp.logged >= *compactMax {
+		return rp.compact()
+	}
+	return nil
+}
+
+// reset replaces the replica with the snapshot in fd.
+func (rp *replica) reset(fd *Feed) error {
+	urls := newStore(nil)
+	var next uint64
+	for _, r := range fd.Records {
+		urls.replay(fd.Seq, r, &next)
+	}
+	// Empty the journal first, so that a crash cannot leave records
+	// from before the reset to be replayed on top of the snapshot.
+	if err := rp.j.truncate(); err != nil {
+		return err
+	}
+	rs := append(fd.Records, record{Epoch: fd.Epoch})
+	if err := writeSnapshot(snapshotName(rp.filename), fd.Seq, rs); err != nil {
+		return err
+	}
+	rp.mu.Lock()
+	rp.urls, rp.seq = urls, fd.Seq
+	rp.mu.Unlock()
+	rp.j.seq, rp.epoch, rp.logged = fd.Seq, fd.Epoch, 0
+	return nil
+}
+
+// compact writes the replica's contents to its snapshot file and
+// empties its journal.
+func (rp *replica) compact() error {
+	rs := append(rp.urls.records(), record{Epoch: rp.epoch})
+	if err := writeSnapshot(snapshotName(rp.filename), rp.j.seq, rs); err != nil {
+		return err
+	}
+	if err := rp.j.truncate(); err != nil {
+		return err
+	}
+	rp.logged = 0
+	return nil
+}
+
+// EnableReplica makes the store keep a full copy of the master's links
+// in filename, so that it can answer for any key without asking.
+func (s *ProxyStore) EnableReplica(filename string) error {
+	rp, err := openReplica(filename)
+	if err != nil {
+		return err
+	}
+	s.replica = rp
+	go s.followLoop()
+	return nil
+}
+
+// followLoop follows the master's journal into the replica until the
+// store is closed.
+func (s *ProxyStore) followLoop() {
+	rp := s.replica
+	defer rp.j.close()
+	for {
+		fl := rp.position()
+		var fd Feed
+		err := s.client.Call("Store.Follow", &fl, &fd)
+		if err == errClosed {
+			return
+		}
+		if err == nil {
+			err = rp.apply(&fd)
+		}
+		if err != nil {
+			if err != errUnavailable {
+				log.Println("ProxyStore: replica:", err)
+			}
+			time.Sleep(pollInterval)
+			continue
+		}
+		if fd.Reset {
+			if fd.Done {
+				s.urls.clear()
+			}
+			continue
+		}
+		for _, r := range fd.Records {
+			s.forget(r)
+		}
+	}
+}
+
+// forget drops from the cache any key that r changes, including any
+// note that the key is missing.
+func (s *ProxyStore) forget(r record) {
+	for _, b := range r.Batch {
+		s.forget(b)
+	}
+	if r.Key != "" {
+		s.urls.drop(r.Key)
+	}
+}
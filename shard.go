@@ -0,0 +1,218 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// In sharded mode the keyspace is split between several masters by
+// consistent hashing: each master is given many points on a ring of
+// hash values, and a key belongs to the master with the first point at
+// or after the key's hash. Adding or removing a master moves only the
+// keys between its points and the ones before them.
+
+const shardPoints = 128 // points on the ring for each shard
+
+var errWrongShard = errors.New("key belongs to another shard")
+
+// The ring, and this master's name on it, when sharded.
+var (
+	shardRing *hashRing
+	shardSelf string
+)
+
+type hashRing struct {
+	shards []string
+	points []ringPoint // in order of hash
+}
+
+type ringPoint struct {
+	hash  uint32
+	shard string
+}
+
+func newHashRing(shards []string) *hashRing {
+	r := &hashRing{shards: shards}
+	for _, s := range shards {
+		for i := 0; i < shardPoints; i++ {
+			r.points = append(r.points, ringPoint{ringHash(s + "#" + strconv.Itoa(i)), s})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		p, q := r.points[i], r.points[j]
+		return p.hash < q.hash || p.hash == q.hash && p.shard < q.shard
+	})
+	return r
+}
+
+// ringHash hashes with MD5, as ketama does: cheaper hashes such as FNV
+// spread names that differ only in their last few bytes, like the
+// addresses of shards, poorly around the ring.
+func ringHash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// owner returns the shard that key belongs to. Keys are placed by
+// their normalized form, so that every spelling of a key that lookups
+// fold together is sent to the shard that holds it.
+func (r *hashRing) owner(key string) string {
+	h := ringHash(normalizeKey(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// has reports whether shard is on the ring.
+func (r *hashRing) has(shard string) bool {
+	for _, s := range r.shards {
+		if s == shard {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsKey reports whether key belongs on this master.
+func ownsKey(key string) bool {
+	return shardRing == nil || shardRing.owner(key) == shardSelf
+}
+
+// keyTries returns how many keys a generator that can repeat should
+// try before giving up. A shard can use only the keys it owns, so it
+// needs more tries the more shards there are.
+func keyTries() int {
+	if shardRing == nil {
+		return maxKeyTries
+	}
+	return maxKeyTries * len(shardRing.shards)
+}
+
+// rebalance moves the keys held by the masters at from that belong
+// elsewhere on ring to their owners. It is for use after a shard is
+// added or removed, with from listing the old shards, once every
+// master is running with the new list. Links are copied before they
+// are deleted, so every key is on its old owner or its new one, but
+// until it has moved its new owner, where slaves send lookups, lacks
+// it; slaves run with -oldshards look on the old owner too. Edit
+// history does not move with its key.
+func rebalance(from []string, ring *hashRing) error {
+	masters := make(map[string]*masterClient)
+	client := func(addr string) *masterClient {
+		if masters[addr] == nil {
+			masters[addr] = newMasterClient(addr)
+		}
+		return masters[addr]
+	}
+	for _, addr := range from {
+		src := client(addr)
+		var spaces []Namespace
+		if err := src.Call("Store.Namespaces", new(int), &spaces); err != nil {
+			return fmt.Errorf("%s: %v", addr, err)
+		}
+		names := []string{""}
+		for _, n := range spaces {
+			names = append(names, n.Name)
+		}
+		for _, ns := range names {
+			var keys []string
+			if err := src.Call("Store.List", &ns, &keys); err != nil {
+				return fmt.Errorf("%s: %v", addr, err)
+			}
+			moves := make(map[string][]string)
+			for _, k := range keys {
+				if o := ring.owner(k); o != addr {
+					moves[o] = append(moves[o], k)
+				}
+			}
+			for dst, keys := range moves {
+				if ns != "" {
+					created := new(Namespace)
+					err := remoteError(client(dst).Call("Store.AddNamespace", &Namespace{Name: ns}, created))
+					if err != nil && err != errNamespaceExists {
+						return fmt.Errorf("%s: %v", dst, err)
+					}
+				}
+				for len(keys) > 0 {
+					n := len(keys)
+					if n > maxBatch {
+						n = maxBatch
+					}
+					moved, err := moveKeys(src, client(dst), keys[:n])
+					if err != nil {
+						return fmt.Errorf("moving keys from %s to %s: %v", addr, dst, err)
+					}
+					fmt.Printf("moved %d keys from %s to %s\n", moved, addr, dst)
+					keys = keys[n:]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// moveKeys copies keys from src to dst and then deletes them from src,
+// returning how many it deleted. Keys that have expired or gone are
+// skipped.
+func moveKeys(src, dst *masterClient, keys []string) (int, error) {
+	var rs []Result
+	if err := src.Call("Store.GetMulti", &keys, &rs); err != nil {
+		return 0, err
+	}
+	var links []CustomLink
+	for _, r := range rs {
+		if r.err() == nil {
+			links = append(links, CustomLink{Key: r.Key, Link: r.Link})
+		}
+	}
+	rs = nil
+	if err := dst.Call("Store.Import", &links, &rs); err != nil {
+		return 0, err
+	}
+	// Keep any key the destination refused, or already had with
+	// another URL.
+	keys = keys[:0]
+	for _, l := range links {
+		keys = append(keys, l.Key)
+	}
+	rs = nil
+	if err := dst.Call("Store.GetMulti", &keys, &rs); err != nil {
+		return 0, err
+	}
+	moved := 0
+	for i, r := range rs {
+		if r.err() != nil || r.Link.URL != links[i].URL {
+			fmt.Printf("not moving %s: the new shard refused it or has it pointing elsewhere\n", r.Key)
+			continue
+		}
+		var url string
+		switch err := remoteError(src.Call("Store.Delete", &r.Key, &url)); err {
+		case nil:
+			moved++
+		case errNotFound:
+		default:
+			return moved, err
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2011 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//      http://www.apache.org/licenses/LICENSE-2.0
+// 
+//      Unless required by applicable law or agreed to in writing, software
+//      distributed under the License is distributed on an "AS IS" BASIS,
+//      WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//      See the License for the specific language governing permissions and
+//      limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHashRingAddShard(t *testing.T) {
+	tests := []struct {
+		shards []string
+		added  string
+	}{
+		{[]string{"a:8080"}, "b:8080"},
+		{[]string{"a:8080", "b:8080"}, "c:8080"},
+		{[]string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}, "10.0.0.4:8080"},
+		{[]string{"10.0.0.1:8080", "10.0.0.3:8080"}, "10.0.0.2:8080"},
+	}
+	const nkeys = 10000
+	for _, tt := range tests {
+		old := newHashRing(tt.shards)
+		ring := newHashRing(append(append([]string(nil), tt.shards...), tt.added))
+		moved := 0
+		for i := 0; i < nkeys; i++ {
+			key := genKey(uint64(i))
+			if i%2 == 1 {
+				key = "ns/custom-" + strconv.Itoa(i)
+			}
+			was, is := old.owner(key), ring.owner(key)
+			if is != was {
+				if is != tt.added {
+					t.Errorf("adding %s to %v: %q moved from %s to %s", tt.added, tt.shards, key, was, is)
+				}
+				moved++
+			}
+		}
+		// The new shard should take about its share of the keys.
+		want := nkeys / (len(tt.shards) + 1)
+		if moved < want/2 || moved > want*2 {
+			t.Errorf("adding %s to %v moved %d of %d keys, want about %d", tt.added, tt.shards, moved, nkeys, want)
+		}
+	}
+}
+
+func TestHashRingFoldsKeys(t *testing.T) {
+	defer setAlphabet("base62")
+	setAlphabet("crockford")
+	ring := newHashRing([]string{"a:8080", "b:8080", "c:8080"})
+	tests := [][]string{
+		{"foo", "Foo", "FOO", "f00"},
+		{"qux", "QUX", "Qux"},
+		{"dev/il", "dev/IL", "dev/11"},
+	}
+	for _, spellings := range tests {
+		want := ring.owner(spellings[0])
+		for _, key := range spellings[1:] {
+			if got := ring.owner(key); got != want {
+				t.Errorf("owner(%q) = %s, want %s as for %q", key, got, want, spellings[0])
+			}
+		}
+	}
+}
@@ -15,166 +15,1583 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/nf/stat"
-	"io"
 	"log"
 	"net/rpc"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	saveTimeout     = 10e9
 	saveQueueLength = 1000
+	saveWait        = 1e9 // how long to wait for room in a full save queue
+	changesKept     = 10000
+	pollInterval    = 1e9
+	reapInterval    = 60e9
+	expiredKept     = 24 * time.Hour // answer "expired" this long before forgetting a key
+	maxBatch        = 1000
+)
+
+var (
+	errNotFound  = errors.New("key not found")
+	errExpired   = errors.New("key expired")
+	errKeyExists = errors.New("key already exists")
+	errBadKey    = errors.New("invalid key")
+	errReserved  = errors.New("key is reserved")
+	errClosed    = errors.New("store is closed")
+	errBusy      = errors.New("store is busy")
+	errDegraded  = errors.New("store cannot save")
+	errKeySpace  = errors.New("no free key found")
+	errBatchSize = errors.New("batch too large")
 )
 
 type Store interface {
 	Put(url, key *string) error
 	Get(key, url *string) error
+	Close() error
+	Health() error
+	PutLink(l *Link, key *string) error
+	PutCustom(c *CustomLink, key *string) error
+	GetLink(key *string, l *Link) error
+	GetMulti(keys *[]string, rs *[]Result) error
+	PutMulti(links *[]CustomLink, rs *[]Result) error
+	Delete(key, url *string) error
+	Update(e *Edit, url *string) error
+	Rollback(r *Rollback, url *string) error
+	History(key *string, h *[]Version) error
+	AddNamespace(ns *Namespace, created *Namespace) error
+	DeleteNamespace(name *string, deleted *Namespace) error
+	Namespaces(_ *int, list *[]Namespace) error
+	List(ns *string, keys *[]string) error
 }
 
 type URLStore struct {
-	mu    sync.RWMutex
-	urls  map[string]string
-	count int
-	save  chan record
+	mu      sync.RWMutex
+	order   sync.Mutex // held by writers from changing the store until the change is queued
+	urls    map[string]string
+	keys    KeyGenerator
+	save    chan saveReq
+	saveMu  sync.RWMutex // held for writing once the store is closed
+	closed  bool
+	saved   chan error           // saveLoop's result, sent when it exits
+	failed  error                // the error that stopped saveLoop saving, if any
+	logged  int                  // records in the tail log since the last snapshot
+	seq     uint64               // last journal sequence number seen by load
+	history map[string][]Version // for keys whose first destination's time is known
+	expires map[string]time.Time // only for keys that expire
+	byURL   map[string]string    // reverse index, if deduplicating
+	folded  map[string]string    // keys by their normalized form, where that differs
+	spaces  map[string]*namespace
+	changed []string  // keys recently edited or deleted
+	chgBase int       // changes trimmed from the front of changed
+	feed    feed      // recent journal records, for slaves to follow
+	raft    *raftNode // nil unless replicated
+	members members   // slaves that have registered
 }
 
+// A record is one entry in the journal. A record with Edited set
+// replaces the destination of an existing key, and one with Deleted
+// set is a tombstone: replaying it removes Key from the store. Next,
+// if set, is the position of the store's sequencer after making Key;
+// a record with only Next set just moves the sequencer. A record with
+// NS set creates or, with Deleted, removes a namespace; its Next is
+// the position of the namespace's own sequencer. A record with Batch
+// set holds records saved together, and replays as each in turn.
 type record struct {
 	Key, URL string
+	Next     uint64     `json:",omitempty"`
+	Lease    *KeyLease  `json:",omitempty"` // only in a slave's lease file
+	Epoch    int64      `json:",omitempty"` // only in a slave's replica file
+	Term     uint64     `json:",omitempty"` // only in a replicated journal
+	NS       *Namespace `json:"Namespace,omitempty"`
+	Author   string     `json:",omitempty"`
+	Time     int64      `json:",omitempty"`
+	Expires  int64      `json:",omitempty"`
+	Edited   bool       `json:",omitempty"`
+	Deleted  bool       `json:",omitempty"`
+	Batch    []record   `json:",omitempty"`
+}
+
+// A Link is a destination URL and the time, if any, after which it
+// stops resolving. When passed to PutLink, Namespace names the
+// namespace to make the new key in, and Author, if set, is kept as the
+// author of the key's first version.
+type Link struct {
+	URL       string
+	Expires   time.Time
+	Namespace string
+	Author    string
+}
+
+// A CustomLink is a Link to be stored under a key chosen by the caller.
+type CustomLink struct {
+	Key string
+	Link
+}
+
+// A Result reports the outcome for one item of a batch: the key and
+// its link, or in Err the text of the error for that item and in Type
+// its kind, as the JSON API gives it for a failed call.
+type Result struct {
+	Key  string
+	Link Link
+	Err  string `json:",omitempty"`
+	Type string `json:",omitempty"`
+}
+
+// fail records err as the item's error.
+func (r *Result) fail(err error) {
+	e := jsonError(err)
+	r.Err, r.Type = e.Message, e.Type
+}
+
+// err returns the error for the item, if any.
+func (r *Result) err() error {
+	if r.Err == "" {
+		return nil
+	}
+	return remoteError(rpc.ServerError(r.Err))
+}
+
+// A Version is one destination a key has pointed to.
+type Version struct {
+	URL    string
+	Author string
+	Time   time.Time
+}
+
+// An Edit asks for Key to be pointed at URL.
+type Edit struct {
+	Key, URL, Author string
+}
+
+// A Rollback asks for Key to be pointed back at an earlier destination,
+// numbered from 1 as in its History.
+type Rollback struct {
+	Key     string
+	Version int
+	Author  string
 }
 
-func NewURLStore(filename string) *URLStore {
-	s := &URLStore{urls: make(map[string]string)}
+// Changes reports the keys edited or deleted in a store, for callers
+// that cache its contents.
+type Changes struct {
+	Keys  []string
+	Next  int  // where the following call should start
+	Reset bool // the history is incomplete; drop everything cached
+}
+
+// A saveReq asks saveLoop to write a record to the journal. saveLoop
+// reports on done once the record has been committed according to the
+// fsync policy, or handed to the OS if the policy leaves syncing to it.
+type saveReq struct {
+	record
+	done chan error
+}
+
+// NewURLStore returns a store saved to filename, or an unsaved one if
+// filename is empty, that makes keys for new links with keys. A store
+// with nil keys accepts only custom keys.
+func NewURLStore(filename string, keys KeyGenerator) *URLStore {
+	s := newStore(keys)
 	if filename != "" {
-		s.save = make(chan record, saveQueueLength)
+		s.save = make(chan saveReq, saveQueueLength)
+		s.saved = make(chan error, 1)
 		if err := s.load(filename); err != nil {
 			log.Println("URLStore:", err)
 		}
+		s.feed.start(s.seq)
 		go s.saveLoop(filename)
 	}
+	go s.reapLoop()
+	return s
+}
+
+// newStore returns an empty, unsaved store with no background work.
+func newStore(keys KeyGenerator) *URLStore {
+	s := &URLStore{
+		urls:    make(map[string]string),
+		keys:    keys,
+		history: make(map[string][]Version),
+		expires: make(map[string]time.Time),
+		spaces:  make(map[string]*namespace),
+		folded:  make(map[string]string),
+	}
+	if *dedup {
+		s.byURL = make(map[string]string)
+	}
 	return s
 }
 
 func (s *URLStore) Get(key, url *string) error {
+	var l Link
+	if err := s.GetLink(key, &l); err != nil {
+		return err
+	}
+	*url = l.URL
+	return nil
+}
+
+// GetLink is like Get but also reports when the link expires.
+func (s *URLStore) GetLink(key *string, l *Link) error {
 	defer statSend("store get")
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	if u, ok := s.urls[*key]; ok {
-		*url = u
-		return nil
+	u, ok := s.urls[*key]
+	if !ok {
+		// A normalized key may stand for one typed otherwise.
+		if k, folded := s.folded[*key]; folded {
+			key = &k
+			u, ok = s.urls[k]
+		}
 	}
-	return errors.New("key not found")
+	if !ok {
+		return errNotFound
+	}
+	exp := s.expires[*key]
+	if !exp.IsZero() && !time.Now().Before(exp) {
+		return errExpired
+	}
+	*l = Link{URL: u, Expires: exp}
+	return nil
 }
 
 func (s *URLStore) Set(key, url *string) error {
+	return s.set(*key, Link{URL: *url}, time.Now().Unix())
+}
+
+// set adds key for l, as its first version made at the Unix time at.
+func (s *URLStore) set(key string, l Link, at int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setLocked(key, l, at)
+}
+
+// setUnique is set for a generated key. If the store is deduplicating
+// and already has a key for l's URL, perhaps added by another Put since
+// putLink's lookup, it stores nothing and returns that key instead.
+func (s *URLStore) setUnique(key string, l Link, at int64) (existing string, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, present := s.urls[*key]; present {
-		return errors.New("key already exists")
+	if l.Expires.IsZero() && s.byURL != nil {
+		if k, ok := s.byURL[indexKey(l.Namespace, l.URL)]; ok {
+			return k, nil
+		}
+	}
+	return "", s.setLocked(key, l, at)
+}
+
+// setLocked is set for a caller holding s.mu.
+func (s *URLStore) setLocked(key string, l Link, at int64) error {
+	if _, present := s.urls[key]; present {
+		return errKeyExists
+	}
+	if _, taken := s.folded[key]; taken {
+		return errKeyExists
 	}
-	s.urls[*key] = *url
+	if f := normalizeKey(key); f != key {
+		// Lookups fall back on the normalized key, so no two keys
+		// may share one.
+		if _, taken := s.urls[f]; taken {
+			return errKeyExists
+		}
+		if k, taken := s.folded[f]; taken && k != key {
+			return errKeyExists
+		}
+	}
+	s.urls[key] = l.URL
+	if !l.Expires.IsZero() {
+		s.expires[key] = l.Expires
+	}
+	s.history[key] = []Version{{URL: l.URL, Author: l.Author, Time: time.Unix(at, 0)}}
+	s.index(key)
 	return nil
 }
 
+// lookup returns the key in namespace ns already pointing at url, if
+// the store is deduplicating and there is one that does not expire.
+func (s *URLStore) lookup(ns, url string) (key string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok = s.byURL[indexKey(ns, url)]
+	return
+}
+
+// indexKey returns the reverse index entry for url in namespace ns.
+func indexKey(ns, url string) string {
+	if ns == "" {
+		return url
+	}
+	return ns + "\x00" + url
+}
+
+// index adds key to the reverse index under its URL, unless another
+// key is there already or key expires, and to the folded index under
+// its normalized form. The caller must hold s.mu.
+func (s *URLStore) index(key string) {
+	if f := normalizeKey(key); f != key {
+		if _, ok := s.folded[f]; !ok {
+			s.folded[f] = key
+		}
+	}
+	if s.byURL == nil {
+		return
+	}
+	if _, ok := s.expires[key]; ok {
+		return
+	}
+	ns, _ := splitKey(key)
+	u := indexKey(ns, s.urls[key])
+	if _, ok := s.byURL[u]; !ok {
+		s.byURL[u] = key
+	}
+}
+
+// unindex removes key from the reverse and folded indexes. The caller
+// must hold s.mu.
+func (s *URLStore) unindex(key string) {
+	if f := normalizeKey(key); s.folded[f] == key {
+		delete(s.folded, f)
+	}
+	if s.byURL == nil {
+		return
+	}
+	ns, _ := splitKey(key)
+	if u, ok := s.urls[key]; ok && s.byURL[indexKey(ns, u)] == key {
+		delete(s.byURL, indexKey(ns, u))
+	}
+}
+
 func (s *URLStore) Put(url, key *string) error {
+	return s.PutLink(&Link{URL: *url}, key)
+}
+
+// PutLink is like Put but the new key is made in namespace
+// l.Namespace, and stops resolving at l.Expires unless that is the
+// zero time.
+func (s *URLStore) PutLink(l *Link, key *string) error {
 	defer statSend("store put")
-	for {
-		*key = genKey(s.count)
-		s.count++
-		if err := s.Set(key, url); err == nil {
+	s.order.Lock()
+	k, r, err := s.putLink(*l)
+	if err != nil {
+		s.order.Unlock()
+		return err
+	}
+	*key = k
+	if r == nil {
+		s.order.Unlock()
+		return nil
+	}
+	return s.logPut(*r)
+}
+
+// putLink adds l under a new key, or finds the key it already has,
+// and returns the record to journal for it, if any.
+func (s *URLStore) putLink(l Link) (key string, r *record, err error) {
+	if l.Expires.IsZero() {
+		if k, ok := s.lookup(l.Namespace, l.URL); ok {
+			return k, nil, nil
+		}
+	}
+	keys, err := s.keysFor(l.Namespace)
+	if err != nil {
+		return "", nil, err
+	}
+	if keys == nil {
+		return "", nil, errors.New("store does not generate keys")
+	}
+	prefix := ""
+	if l.Namespace != "" {
+		prefix = l.Namespace + "/"
+	}
+	var name string
+	now := time.Now().Unix()
+	for i := 0; ; i++ {
+		if name, err = keys.Key(l.URL, i); err != nil {
+			return "", nil, err
+		}
+		if !keyAllowed(name) || !ownsKey(prefix+name) {
+			continue
+		}
+		existing, err := s.setUnique(prefix+name, l, now)
+		if existing != "" {
+			return existing, nil, nil
+		}
+		if err == nil {
+			key = prefix + name
 			break
 		}
 	}
-	if s.save != nil {
-		s.save <- record{*key, *url}
+	var next uint64
+	if _, ok := keys.(sequencer); ok {
+		n, _ := keySeq(name)
+		next = n + 1
 	}
-	return nil
+	return key, putRecord(key, l, next, now), nil
 }
 
-func (s *URLStore) load(filename string) error {
-	f, err := os.Open(filename)
+// PutCustom stores c.Link under c.Key, which must be a valid key that
+// is neither reserved nor already in use. The key may be in a
+// namespace, as in "infra/dash".
+func (s *URLStore) PutCustom(c *CustomLink, key *string) error {
+	defer statSend("store put")
+	s.order.Lock()
+	r, err := s.putCustom(*c, false)
 	if err != nil {
+		s.order.Unlock()
 		return err
 	}
-	defer f.Close()
-	b := bufio.NewReader(f)
-	d := json.NewDecoder(b)
+	*key = r.Key
+	return s.logPut(*r)
+}
+
+// putCustom adds c and returns the record to journal for it. Unless
+// the link was moved from another shard, it refuses keys the store's
+// own sequence has passed.
+func (s *URLStore) putCustom(c CustomLink, moved bool) (*record, error) {
+	ns, name := splitKey(c.Key)
+	if err := checkKey(name); err != nil {
+		return nil, err
+	}
+	if ns == "" && name != c.Key {
+		return nil, errBadKey // a leading slash
+	}
+	if !ownsKey(c.Key) {
+		return nil, errWrongShard
+	}
+	keys, err := s.keysFor(ns)
+	if err != nil {
+		return nil, err
+	}
+	if g, ok := keys.(sequencer); ok && !moved {
+		// The sequencer has handed out this key, or one it folds
+		// to, already, perhaps to a slave that has yet to
+		// replicate it.
+		if n, err := keySeq(normalizeKey(name)); err == nil && n < g.Pos() {
+			return nil, errKeyExists
+		}
+	}
+	now := time.Now().Unix()
+	if err := s.set(c.Key, c.Link, now); err != nil {
+		return nil, err
+	}
+	return putRecord(c.Key, c.Link, 0, now), nil
+}
+
+// putRecord returns the journal record for adding key at the Unix
+// time at.
+func putRecord(key string, l Link, next uint64, at int64) *record {
+	r := &record{Key: key, URL: l.URL, Author: l.Author, Next: next, Time: at}
+	if !l.Expires.IsZero() {
+		r.Expires = l.Expires.Unix()
+	}
+	return r
+}
+
+// logPut saves a newly added key, removing it again if that fails so
+// that callers are never handed a key that will not survive a restart.
+// It releases s.order, as log does.
+func (s *URLStore) logPut(r record) error {
+	return s.log(r, func() { s.drop(r.Key) })
+}
+
+// GetMulti looks up each of keys, as GetLink does.
+func (s *URLStore) GetMulti(keys *[]string, rs *[]Result) error {
+	if len(*keys) > maxBatch {
+		return errBatchSize
+	}
+	*rs = make([]Result, len(*keys))
+	for i, k := range *keys {
+		r := &(*rs)[i]
+		r.Key = k
+		if err := s.GetLink(&k, &r.Link); err != nil {
+			r.fail(err)
+		}
+	}
+	return nil
+}
+
+// PutMulti adds each of links, as PutCustom does for those with a
+// Key and PutLink for the rest. The new keys are journaled as one
+// record, so after a crash either all or none of them remain; if that
+// fails, every item reports the error.
+func (s *URLStore) PutMulti(links *[]CustomLink, rs *[]Result) error {
+	defer statSend("store put multi")
+	return s.putMulti(links, rs, false)
+}
+
+// Import is PutMulti for links that rebalance moves here from another
+// shard. Their keys came from the other shard's sequence, so unlike
+// PutCustom it takes keys this store's sequence may also have reached.
+func (s *URLStore) Import(links *[]CustomLink, rs *[]Result) error {
+	defer statSend("store import")
+	return s.putMulti(links, rs, true)
+}
+
+// putMulti adds links as PutMulti does; moved is as for putCustom.
+func (s *URLStore) putMulti(links *[]CustomLink, rs *[]Result, moved bool) error {
+	if len(*links) > maxBatch {
+		return errBatchSize
+	}
+	*rs = make([]Result, len(*links))
+	var batch []record
+	s.order.Lock()
+	for i, c := range *links {
+		var r *record
+		var err error
+		if c.Key == "" {
+			c.Key, r, err = s.putLink(c.Link)
+		} else if r, err = s.putCustom(c, moved); err == nil {
+			c.Key = r.Key
+		}
+		(*rs)[i] = Result{Key: c.Key, Link: c.Link}
+		if err != nil {
+			(*rs)[i].fail(err)
+		} else if r != nil {
+			batch = append(batch, *r)
+		}
+	}
+	if len(batch) == 0 {
+		s.order.Unlock()
+		return nil
+	}
+	undo := func() {
+		for _, r := range batch {
+			s.drop(r.Key)
+		}
+	}
+	if err := s.log(record{Batch: batch}, undo); err != nil {
+		for i := range *rs {
+			if (*rs)[i].Err == "" {
+				(*rs)[i].fail(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *URLStore) Delete(key, url *string) error {
+	defer statSend("store delete")
+	s.order.Lock()
+	s.mu.Lock()
+	u, ok := s.urls[*key]
+	if !ok {
+		s.mu.Unlock()
+		s.order.Unlock()
+		return errNotFound
+	}
+	old := s.keyState(*key)
+	s.remove(*key)
+	s.change(*key)
+	s.mu.Unlock()
+	*url = u
+	return s.logChange(record{Key: *key, Deleted: true}, old)
+}
+
+// A keyState is everything known about a key, kept while a change to it
+// is journaled so that the change can be undone if that fails.
+type keyState struct {
+	key     string
+	url     string
+	expires time.Time
+	history []Version
+}
+
+// keyState returns key's current state. The caller must hold s.mu.
+func (s *URLStore) keyState(key string) keyState {
+	return keyState{key, s.urls[key], s.expires[key], s.history[key]}
+}
+
+// logChange journals r, which changed the key whose state was old,
+// putting the key back as it was if that fails, as logPut does.
+func (s *URLStore) logChange(r record, old keyState) error {
+	return s.log(r, func() {
+		s.mu.Lock()
+		s.remove(old.key)
+		s.urls[old.key] = old.url
+		if !old.expires.IsZero() {
+			s.expires[old.key] = old.expires
+		}
+		if old.history != nil {
+			s.history[old.key] = old.history
+		}
+		s.index(old.key)
+		s.change(old.key)
+		s.mu.Unlock()
+	})
+}
+
+// remove deletes key and everything known about it. The caller must
+// hold s.mu.
+func (s *URLStore) remove(key string) {
+	s.unindex(key)
+	delete(s.urls, key)
+	delete(s.history, key)
+	delete(s.expires, key)
+}
+
+// reapLoop periodically purges keys that expired more than
+// expiredKept ago, journaling a tombstone for each.
+func (s *URLStore) reapLoop() {
 	for {
-		var r record
-		if err := d.Decode(&r); err == io.EOF {
-			break
-		} else if err != nil {
-			return err
+		time.Sleep(reapInterval)
+		if s.raft != nil && s.raft.leading() != nil {
+			continue // the leader reaps for everyone
+		}
+		cutoff := time.Now().Add(-expiredKept)
+		var keys []string
+		s.mu.RLock()
+		for k, exp := range s.expires {
+			if exp.Before(cutoff) {
+				keys = append(keys, k)
+			}
+		}
+		s.mu.RUnlock()
+		for _, k := range keys {
+			s.order.Lock()
+			s.mu.Lock()
+			exp, ok := s.expires[k]
+			ok = ok && exp.Before(cutoff)
+			if ok {
+				s.remove(k)
+				s.change(k)
+			}
+			s.mu.Unlock()
+			if !ok {
+				s.order.Unlock()
+				continue
+			}
+			if err := s.log(record{Key: k, Deleted: true}, nil); err != nil {
+				log.Println("URLStore:", err)
+			}
+			statSend("store reap")
+		}
+	}
+}
+
+// Update points an existing key at a new URL, keeping the old one in
+// the key's history. The previous URL is returned in url.
+func (s *URLStore) Update(e *Edit, url *string) error {
+	defer statSend("store update")
+	r := record{Key: e.Key, URL: e.URL, Author: e.Author, Time: time.Now().Unix(), Edited: true}
+	s.order.Lock()
+	s.mu.Lock()
+	u, ok := s.urls[e.Key]
+	if !ok {
+		s.mu.Unlock()
+		s.order.Unlock()
+		return errNotFound
+	}
+	old := s.keyState(e.Key)
+	s.edit(r)
+	s.change(e.Key)
+	s.mu.Unlock()
+	*url = u
+	return s.logChange(r, old)
+}
+
+// Rollback points a key back at one of its earlier URLs, recording the
+// change as a new version. The URL restored is returned in url.
+func (s *URLStore) Rollback(rb *Rollback, url *string) error {
+	defer statSend("store rollback")
+	s.order.Lock()
+	s.mu.Lock()
+	h := s.history[rb.Key]
+	if _, ok := s.urls[rb.Key]; !ok {
+		s.mu.Unlock()
+		s.order.Unlock()
+		return errNotFound
+	}
+	if rb.Version < 1 || rb.Version > len(h) {
+		s.mu.Unlock()
+		s.order.Unlock()
+		return errors.New("no such version")
+	}
+	r := record{Key: rb.Key, URL: h[rb.Version-1].URL, Author: rb.Author, Time: time.Now().Unix(), Edited: true}
+	old := s.keyState(rb.Key)
+	s.edit(r)
+	s.change(rb.Key)
+	s.mu.Unlock()
+	*url = r.URL
+	return s.logChange(r, old)
+}
+
+// History lists the destinations a key has pointed to, oldest first.
+// The last entry is the current one.
+func (s *URLStore) History(key *string, h *[]Version) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.urls[*key]
+	if !ok {
+		return errNotFound
+	}
+	if v := s.history[*key]; len(v) > 0 {
+		*h = append([]Version(nil), v...)
+	} else {
+		*h = []Version{{URL: u}}
+	}
+	return nil
+}
+
+// edit applies an edit record. The caller must hold s.mu.
+func (s *URLStore) edit(r record) {
+	if len(s.history[r.Key]) == 0 {
+		// The key was added by a version that did not record
+		// when, or by whom.
+		s.history[r.Key] = []Version{{URL: s.urls[r.Key]}}
+	}
+	v := Version{URL: r.URL, Author: r.Author, Time: time.Unix(r.Time, 0)}
+	h := s.history[r.Key]
+	if h[len(h)-1] == v {
+		return // replayed twice
+	}
+	s.history[r.Key] = append(h, v)
+	s.unindex(r.Key)
+	s.urls[r.Key] = r.URL
+	s.index(r.Key)
+}
+
+// change notes that key has been edited or deleted, so caches holding
+// it, under the key or its normalized form, can let it go. The caller
+// must hold s.mu.
+func (s *URLStore) change(key string) {
+	s.changed = append(s.changed, key)
+	if f := normalizeKey(key); f != key {
+		s.changed = append(s.changed, f)
+	}
+	if n := len(s.changed) - changesKept; n > 0 {
+		s.changed = append([]string(nil), s.changed[n:]...)
+		s.chgBase += n
+	}
+}
+
+// Changed lists the keys edited or deleted since the point since in
+// the store's change history. Only the most recent changes are kept,
+// and none survive a restart, so a caller that has fallen behind is
+// told to Reset.
+func (s *URLStore) Changed(since *int, c *Changes) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c.Next = s.chgBase + len(s.changed)
+	if *since < s.chgBase || *since > c.Next {
+		c.Reset = true
+		return nil
+	}
+	c.Keys = append([]string(nil), s.changed[*since-s.chgBase:]...)
+	return nil
+}
+
+// drop removes key from the store without journaling anything.
+func (s *URLStore) drop(key string) {
+	s.mu.Lock()
+	s.remove(key)
+	s.mu.Unlock()
+}
+
+// records returns the records needed to rebuild the store's current
+// contents.
+func (s *URLStore) records() []record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rs := make([]record, 0, len(s.spaces)+len(s.urls))
+	for _, n := range s.spaces {
+		r := record{NS: &Namespace{}}
+		*r.NS = n.Namespace
+		if g, ok := n.keys.(sequencer); ok {
+			r.Next = g.Pos()
+		}
+		rs = append(rs, r)
+	}
+	for k, u := range s.urls {
+		var exp int64
+		if t, ok := s.expires[k]; ok {
+			exp = t.Unix()
+		}
+		h := s.history[k]
+		if len(h) == 0 {
+			rs = append(rs, record{Key: k, URL: u, Expires: exp})
+			continue
+		}
+		for i, v := range h {
+			r := record{Key: k, URL: v.URL, Author: v.Author, Edited: i > 0}
+			if i == 0 {
+				r.Expires = exp
+			}
+			if !v.Time.IsZero() {
+				r.Time = v.Time.Unix()
+			}
+			rs = append(rs, r)
 		}
-		if err = s.Set(&r.Key, &r.URL); err != nil {
+	}
+	if g, ok := s.keys.(sequencer); ok {
+		rs = append(rs, record{Next: g.Pos()})
+	}
+	return rs
+}
+
+// log saves r, the record of a change the caller has made to the
+// store while holding s.order. It releases s.order once r is queued,
+// so that records are saved in the order their changes were made, and
+// then waits for r to be saved, as queue describes. If that fails,
+// undo, unless nil, is called with s.order held to reverse the change;
+// but not for errUncommitted, as the raft node puts the store right.
+func (s *URLStore) log(r record, undo func()) error {
+	wait, err := s.queue(r)
+	if err == nil {
+		s.order.Unlock()
+		err = wait()
+		if err == nil || err == errUncommitted {
 			return err
 		}
+		s.order.Lock()
+	}
+	if undo != nil {
+		undo()
+	}
+	s.order.Unlock()
+	return err
+}
+
+// queue queues r to be saved, and returns a function that waits until
+// r has been committed to disk, or with the fsync policy that leaves
+// that to the OS, until r has been handed to it. It fails at once if the store is degraded, and with
+// errBusy if the save queue stays full for longer than saveWait. In
+// replicated mode it appends r to the journal, and the function waits
+// for r to be committed, failing with errUncommitted if it cannot tell
+// whether r will be.
+func (s *URLStore) queue(r record) (wait func() error, err error) {
+	if s.raft != nil {
+		return s.raft.propose(r)
+	}
+	if s.save == nil {
+		return func() error { return nil }, nil
+	}
+	if s.Health() != nil {
+		return nil, errDegraded
+	}
+	req := saveReq{record: r, done: make(chan error, 1)}
+	s.saveMu.RLock()
+	if s.closed {
+		s.saveMu.RUnlock()
+		return nil, errClosed
+	}
+	select {
+	case s.save <- req:
+	case <-time.After(saveWait):
+		s.saveMu.RUnlock()
+		statSend("store busy")
+		return nil, errBusy
+	}
+	s.saveMu.RUnlock()
+	return func() error { return <-req.done }, nil
+}
+
+// load reads the snapshot, if any, followed by the tail log.
+func (s *URLStore) load(filename string) error {
+	var next uint64
+	if g, ok := s.keys.(sequencer); ok {
+		defer func() { g.Seek(next) }()
+	}
+	_, err := readJournal(snapshotName(filename), false, func(seq uint64, r record) {
+		s.replay(seq, r, &next)
+	})
+	snapped := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// A crash during compaction leaves the old tail beside the new
+	// snapshot; skip the records the snapshot already covers. That
+	// includes any records written before sequence numbers, which only
+	// the first snapshot can follow.
+	snapSeq := s.seq
+	tail := func(seq uint64, r record) {
+		if seq > snapSeq || seq == 0 && !snapped {
+			s.replay(seq, r, &next)
+		}
+	}
+	// The journal set aside by a compaction still in progress comes
+	// before the current one.
+	old, err := readJournal(oldTailName(filename), true, tail)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.logged, err = readJournal(filename, true, tail)
+	s.logged += old
+	return err
+}
+
+// replay applies a record read from a journal, with sequence number
+// seq, to the store. It moves next past any key made by the store's own
+// sequencer. Replaying a record more than once does no harm.
+func (s *URLStore) replay(seq uint64, r record, next *uint64) {
+	if seq > s.seq {
+		s.seq = seq
+	}
+	for _, b := range r.Batch {
+		s.replay(seq, b, next)
+	}
+	if r.NS != nil {
+		s.mu.Lock()
+		if r.Deleted {
+			delete(s.spaces, r.NS.Name)
+		} else {
+			s.newNamespace(*r.NS, r.Next)
+		}
+		s.mu.Unlock()
+		return
+	}
+	if ns, _ := splitKey(r.Key); ns != "" {
+		if n, ok := s.spaces[ns]; ok && r.Next > 0 {
+			if g, ok := n.keys.(sequencer); ok {
+				g.Seek(r.Next)
+			}
+		}
+	} else if r.Next > *next {
+		*next = r.Next
+	} else if seq == 0 && !r.Deleted {
+		// Records from older versions do not carry Next,
+		// but all their keys were made by genKey.
+		if n, err := keySeq(r.Key); err == nil && n >= *next {
+			*next = n + 1
+		}
+	}
+	if r.Key == "" {
+		return
+	}
+	s.mu.Lock()
+	switch {
+	case r.Deleted:
+		s.remove(r.Key)
+		s.change(r.Key)
+	case r.Edited:
+		s.edit(r)
+		s.change(r.Key)
+	default:
+		s.remove(r.Key)
+		s.urls[r.Key] = r.URL
+		if r.Expires != 0 {
+			s.expires[r.Key] = time.Unix(r.Expires, 0)
+		}
+		if r.Time != 0 {
+			s.history[r.Key] = []Version{{URL: r.URL, Author: r.Author, Time: time.Unix(r.Time, 0)}}
+		}
+		s.index(r.Key)
+	}
+	s.mu.Unlock()
+}
+
+// Health reports why the store cannot save records, or nil if it can.
+// Once saving has failed the store stays degraded until it is restarted,
+// since records may already have been lost.
+func (s *URLStore) Health() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.failed != nil {
+		return fmt.Errorf("%v: %v", errDegraded, s.failed)
 	}
 	return nil
 }
 
+// QueueLen returns the number of records waiting to be saved.
+func (s *URLStore) QueueLen() int {
+	return len(s.save)
+}
+
+// Close stops accepting writes, saves everything still queued, and
+// syncs the data file. It reports the first error that may have cost
+// a record since the store was opened.
+func (s *URLStore) Close() error {
+	if s.save == nil {
+		return nil
+	}
+	s.saveMu.Lock()
+	if s.closed {
+		s.saveMu.Unlock()
+		return errClosed
+	}
+	s.closed = true
+	close(s.save)
+	s.saveMu.Unlock()
+	return <-s.saved
+}
+
 func (s *URLStore) saveLoop(filename string) {
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
+	var lost error // first error that may have lost a record
+	defer func() { s.saved <- lost }()
+	fail := func(err error) {
 		log.Println("URLStore:", err)
+		statSend("store save error")
+		if lost == nil {
+			lost = err
+			s.mu.Lock()
+			s.failed = err
+			s.mu.Unlock()
+		}
+	}
+	j, err := openJournal(filename, s.seq)
+	if err != nil {
+		fail(err)
 		return
 	}
-	b := bufio.NewWriter(f)
-	e := json.NewEncoder(b)
-	t := time.NewTicker(saveTimeout)
-	defer f.Close()
-	defer b.Flush()
+	var compacting chan error // the result of the compaction in progress
+	if _, err := os.Stat(oldTailName(filename)); err == nil {
+		// Finish the compaction a crash cut short.
+		compacting = s.clone().saveSnapshot(filename, j.seq)
+	}
+	canCompact := *compactMax > 0
+	// Only a group commit needs a ticker; otherwise each record is
+	// synced, or handed to the OS, as it is appended.
+	var tick <-chan time.Time
+	if syncEvery > 0 {
+		t := time.NewTicker(time.Duration(syncEvery))
+		defer t.Stop()
+		tick = t.C
+	}
+	var waiting []chan error
+	release := func(err error) {
+		for _, c := range waiting {
+			c <- err
+		}
+		waiting = waiting[:0]
+	}
 	for {
 		var err error
 		select {
-		case r := <-s.save:
-			err = e.Encode(r)
-		case <-t.C:
-			err = b.Flush()
+		case r, ok := <-s.save:
+			if !ok {
+				err = j.close()
+				release(err)
+				if err != nil {
+					fail(err)
+				}
+				if compacting != nil {
+					if err := <-compacting; err != nil {
+						log.Println("URLStore: compaction:", err)
+					}
+				}
+				return
+			}
+			if err = j.append(r.record); err == nil {
+				s.feed.publish(j.seq, r.record)
+				s.logged++
+				switch syncEvery {
+				case syncAlways:
+					err = j.sync()
+				case syncNone:
+					err = j.flush()
+				}
+			}
+			waiting = append(waiting, r.done)
+			if err != nil || syncEvery == syncAlways || syncEvery == syncNone {
+				release(err)
+			}
+			if err == nil && canCompact && compacting == nil && s.logged >= *compactMax {
+				j, compacting, err = s.compactLog(filename, j, release)
+			}
+		case err := <-compacting:
+			compacting = nil
+			if err != nil {
+				// The journal set aside must stay until a
+				// snapshot covers it, so there can be no more
+				// compactions until a restart finishes this one.
+				log.Println("URLStore: compaction:", err)
+				canCompact = false
+			}
+		case <-tick:
+			err = j.sync()
+			release(err)
 		}
 		if err != nil {
-			log.Println("URLStore:", err)
+			fail(err)
 		}
 	}
 }
 
+// compactLog starts a compaction. It closes the journal, releasing the
+// records waiting to be synced, sets it aside and carries on in a new
+// one, then writes a copy of the store to the snapshot in the
+// background. Every record in the old journal was applied to the store
+// before it was queued for saving, so the snapshot covers it, and the
+// old journal is removed once the snapshot is safe. The returned
+// channel yields the result.
+func (s *URLStore) compactLog(filename string, j *journal, release func(error)) (*journal, chan error, error) {
+	seq := j.seq
+	err := j.close()
+	release(err)
+	if err != nil {
+		return j, nil, err
+	}
+	err = os.Rename(filename, oldTailName(filename))
+	if err == nil {
+		err = syncDir(filepath.Dir(filename))
+	}
+	nj, oerr := openJournal(filename, seq)
+	if oerr != nil {
+		return j, nil, oerr
+	}
+	if err != nil {
+		log.Println("URLStore: compaction:", err)
+		return nj, nil, nil
+	}
+	s.logged = 0
+	return nj, s.clone().saveSnapshot(filename, seq), nil
+}
+
+// clone returns a copy of the store's links and namespaces, so that a
+// snapshot can be written without holding up writers. Histories are
+// shared, as they are only ever appended to.
+func (s *URLStore) clone() *URLStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := &URLStore{
+		urls:    make(map[string]string, len(s.urls)),
+		keys:    s.keys,
+		history: make(map[string][]Version, len(s.history)),
+		expires: make(map[string]time.Time, len(s.expires)),
+		spaces:  make(map[string]*namespace, len(s.spaces)),
+	}
+	for k, u := range s.urls {
+		c.urls[k] = u
+	}
+	for k, h := range s.history {
+		c.history[k] = h
+	}
+	for k, t := range s.expires {
+		c.expires[k] = t
+	}
+	for name, n := range s.spaces {
+		cn := *n
+		c.spaces[name] = &cn
+	}
+	return c
+}
+
+// saveSnapshot writes s to the snapshot as of seq in the background
+// and then removes the journal set aside, returning a channel that
+// yields the result.
+func (s *URLStore) saveSnapshot(filename string, seq uint64) chan error {
+	done := make(chan error, 1)
+	go func() {
+		err := writeSnapshot(snapshotName(filename), seq, s.records())
+		if err == nil {
+			err = os.Remove(oldTailName(filename))
+		}
+		done <- err
+	}()
+	return done
+}
+
 type ProxyStore struct {
-	urls   *URLStore
-	client *rpc.Client
+	urls       *linkCache
+	client     *masterClient            // the master, or the first shard's
+	shards     []*masterClient          // every shard's master, if sharded
+	ring       *hashRing                // nil unless sharded
+	oldRing    *hashRing                // the shards before the last change, while keys move
+	oldMasters map[string]*masterClient // the masters on oldRing, by address
+	fetches    fetchGroup
+	lease      *keyLeaser // nil unless leasing keys from the master
+	replica    *replica   // nil unless keeping a replica
+	ruled      int32      // set, atomically, once the master's key rules are in use
 }
 
 func NewProxyStore(addr string) *ProxyStore {
-	client, err := rpc.DialHTTP("tcp", addr)
-	if err != nil {
-		log.Println("ProxyStore:", err)
+	return NewShardedProxyStore([]string{addr})
+}
+
+// NewShardedProxyStore returns a ProxyStore for a keyspace split
+// between the masters at addrs.
+func NewShardedProxyStore(addrs []string) *ProxyStore {
+	s := &ProxyStore{urls: newLinkCache(*cacheSize, *cacheMem, *cacheTTL)}
+	for _, addr := range addrs {
+		s.shards = append(s.shards, newMasterClient(addr))
+	}
+	s.client = s.shards[0]
+	if len(addrs) > 1 {
+		s.ring = newHashRing(addrs)
 	}
-	return &ProxyStore{urls: NewURLStore(""), client: client}
+	if err := s.useMasterRules(); err != nil {
+		log.Println("ProxyStore: key rules:", err)
+	}
+	for _, c := range s.shards {
+		go s.pollChanges(c)
+		go s.heartbeatLoop(c)
+	}
+	return s
 }
 
-func (s *ProxyStore) Get(key, url *string) error {
-	if err := s.urls.Get(key, url); err == nil {
+// EnablePreviousShards makes s look for keys that their masters lack
+// on the masters that owned them under old, the shard list in use
+// before the last change, which may still hold them until rebalance
+// has moved them.
+func (s *ProxyStore) EnablePreviousShards(old []string) {
+	s.oldRing = newHashRing(old)
+	s.oldMasters = make(map[string]*masterClient)
+	for _, addr := range old {
+		c := newMasterClient(addr)
+		for _, sc := range s.shards {
+			if sc.addrs[0] == addr {
+				c = sc
+			}
+		}
+		s.oldMasters[addr] = c
+	}
+}
+
+// previous returns the master that owned key before the last change to
+// the shards, if that was another, while keys are being moved.
+func (s *ProxyStore) previous(key string) *masterClient {
+	if s.oldRing == nil {
+		return nil
+	}
+	owner := s.oldRing.owner(key)
+	if owner == s.master(key).addrs[0] {
 		return nil
 	}
-	if err := s.client.Call("Store.Get", key, url); err != nil {
+	return s.oldMasters[owner]
+}
+
+// master returns the master for key, which for new keys may be a URL.
+func (s *ProxyStore) master(key string) *masterClient {
+	if s.ring == nil {
+		return s.client
+	}
+	owner := s.ring.owner(key)
+	for _, c := range s.shards {
+		if c.addrs[0] == owner {
+			return c
+		}
+	}
+	return s.client
+}
+
+// useMasterRules adopts the master's alphabet and blocklist, so that
+// keys are made and filtered the same way everywhere.
+func (s *ProxyStore) useMasterRules() error {
+	var r KeyRules
+	if err := s.client.Call("Store.KeyRules", new(int), &r); err != nil {
 		return err
 	}
-	s.urls.Set(key, url)
+	kf, err := parseKeyFilter(r.Blocklist)
+	if err != nil {
+		return err
+	}
+	if err := setAlphabet(r.Alphabet); err != nil {
+		return err
+	}
+	setBlocklist(kf)
+	atomic.StoreInt32(&s.ruled, 1)
+	return nil
+}
+
+// rulesKnown reports whether the slave has its master's key rules.
+func (s *ProxyStore) rulesKnown() bool {
+	return atomic.LoadInt32(&s.ruled) != 0
+}
+
+// pollChanges keeps the cache in step with edits and deletions on the
+// master by dropping the keys it reports as changed. Changes made
+// while disconnected are unknown, so a new connection empties the
+// cache.
+func (s *ProxyStore) pollChanges(m *masterClient) {
+	since, gen := 0, 0
+	for {
+		time.Sleep(pollInterval)
+		var c Changes
+		if err := m.Call("Store.Changed", &since, &c); err != nil {
+			if err != errUnavailable && err != errClosed {
+				log.Println("ProxyStore:", err)
+			}
+			continue
+		}
+		if g := m.generation(); g != gen || !s.rulesKnown() {
+			c.Reset = c.Reset || gen != 0 && g != gen
+			gen = g
+			// The master may have been restarted with other rules,
+			// or have been down when the slave started.
+			if m == s.client {
+				if err := s.useMasterRules(); err != nil {
+					log.Println("ProxyStore: key rules:", err)
+				}
+			}
+		}
+		if c.Reset {
+			s.urls.clear()
+		}
+		for _, k := range c.Keys {
+			s.urls.drop(k)
+		}
+		since = c.Next
+	}
+}
+
+func (s *ProxyStore) Health() error {
+	for _, c := range s.shards {
+		if err := c.Health(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Masters reports the state of the connections to the masters.
+func (s *ProxyStore) Masters() []MasterStatus {
+	var st []MasterStatus
+	for _, c := range s.shards {
+		st = append(st, c.Status())
+	}
+	return st
+}
+
+func (s *ProxyStore) Close() error {
+	var err error
+	if s.lease != nil {
+		err = s.closeLease()
+	}
+	for _, c := range s.shards {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *ProxyStore) Get(key, url *string) error {
+	var l Link
+	if err := s.GetLink(key, &l); err != nil {
+		return err
+	}
+	*url = l.URL
 	return nil
 }
 
+func (s *ProxyStore) GetLink(key *string, l *Link) error {
+	cl, err := s.urls.get(*key)
+	if err == errNotCached && s.replica != nil {
+		cl, err = s.replica.get(*key)
+	}
+	if err == errNotCached {
+		cl, err = s.fetches.do(*key, func() (Link, error) {
+			return s.fetch(*key)
+		})
+	}
+	*l = cl
+	return err
+}
+
+// fetch asks the master for the link for key and caches the answer.
+func (s *ProxyStore) fetch(key string) (Link, error) {
+	var l Link
+	err := remoteError(s.master(key).Call("Store.GetLink", &key, &l))
+	if m := s.previous(key); err == errNotFound && m != nil {
+		err = remoteError(m.Call("Store.GetLink", &key, &l))
+	}
+	switch err {
+	case nil:
+		s.urls.add(key, l)
+	case errNotFound:
+		s.urls.miss(key)
+	}
+	return l, err
+}
+
 func (s *ProxyStore) Put(url, key *string) error {
-	if err := s.client.Call("Store.Put", url, key); err != nil {
+	return s.PutLink(&Link{URL: *url}, key)
+}
+
+func (s *ProxyStore) PutLink(l *Link, key *string) error {
+	if k, ok := s.urls.lookup(l.Namespace, l.URL); ok && l.Expires.IsZero() {
+		*key = k
+		return nil
+	}
+	if s.lease != nil && l.Namespace == "" {
+		k, err := s.leasedKey(*l)
+		if err != nil {
+			return err
+		}
+		*key = k
+		return nil
+	}
+	if err := s.master(indexKey(l.Namespace, l.URL)).Call("Store.PutLink", l, key); err != nil {
+		return remoteError(err)
+	}
+	s.urls.add(*key, *l)
+	return nil
+}
+
+func (s *ProxyStore) PutCustom(c *CustomLink, key *string) error {
+	_, name := splitKey(c.Key)
+	if err := checkKey(name); err != nil {
 		return err
 	}
-	s.urls.Set(key, url)
+	if err := s.master(c.Key).Call("Store.PutCustom", c, key); err != nil {
+		return remoteError(err)
+	}
+	s.urls.add(*key, c.Link)
+	return nil
+}
+
+func (s *ProxyStore) Delete(key, url *string) error {
+	if err := s.master(*key).Call("Store.Delete", key, url); err != nil {
+		return remoteError(err)
+	}
+	s.urls.drop(*key)
+	return nil
+}
+
+func (s *ProxyStore) Update(e *Edit, url *string) error {
+	if err := s.master(e.Key).Call("Store.Update", e, url); err != nil {
+		return remoteError(err)
+	}
+	s.urls.drop(e.Key)
+	return nil
+}
+
+func (s *ProxyStore) Rollback(r *Rollback, url *string) error {
+	if err := s.master(r.Key).Call("Store.Rollback", r, url); err != nil {
+		return remoteError(err)
+	}
+	s.urls.drop(r.Key)
+	return nil
+}
+
+func (s *ProxyStore) History(key *string, h *[]Version) error {
+	return remoteError(s.master(*key).Call("Store.History", key, h))
+}
+
+// GetMulti answers what it can from the cache and asks the masters for
+// the rest, in one call to each.
+func (s *ProxyStore) GetMulti(keys *[]string, rs *[]Result) error {
+	if len(*keys) > maxBatch {
+		return errBatchSize
+	}
+	*rs = make([]Result, len(*keys))
+	miss := make(map[*masterClient][]int) // indexes in rs to fetch from each master
+	for i, k := range *keys {
+		r := &(*rs)[i]
+		r.Key = k
+		l, err := s.urls.get(k)
+		switch err {
+		case nil:
+			r.Link = l
+		case errNotCached:
+			m := s.master(k)
+			miss[m] = append(miss[m], i)
+		default:
+			r.fail(err)
+		}
+	}
+	for m, at := range miss {
+		keys := make([]string, len(at))
+		for i, j := range at {
+			keys[i] = (*rs)[j].Key
+		}
+		var fetched []Result
+		err := m.Call("Store.GetMulti", &keys, &fetched)
+		if err == nil && len(fetched) != len(keys) {
+			err = errors.New("master answered the wrong number of keys")
+		}
+		if err != nil {
+			if s.ring == nil {
+				return remoteError(err)
+			}
+			for _, j := range at {
+				(*rs)[j].fail(remoteError(err))
+			}
+			continue
+		}
+		for i, r := range fetched {
+			if r.err() == errNotFound && s.previous(r.Key) != nil {
+				r = Result{Key: r.Key}
+				var err error
+				if r.Link, err = s.fetch(r.Key); err != nil {
+					r.fail(err)
+				}
+				(*rs)[at[i]] = r
+				continue
+			}
+			switch r.err() {
+			case nil:
+				s.urls.add(r.Key, r.Link)
+			case errNotFound:
+				s.urls.miss(r.Key)
+			}
+			(*rs)[at[i]] = r
+		}
+	}
 	return nil
 }
 
+// PutMulti sends the batch to the masters, split between them as
+// PutCustom and PutLink would, and caches the new links.
+func (s *ProxyStore) PutMulti(links *[]CustomLink, rs *[]Result) error {
+	if len(*links) > maxBatch {
+		return errBatchSize
+	}
+	*rs = make([]Result, len(*links))
+	batches := make(map[*masterClient][]int) // indexes in links for each master
+	for i, c := range *links {
+		m := s.master(c.Key)
+		if c.Key == "" {
+			m = s.master(indexKey(c.Namespace, c.URL))
+		}
+		batches[m] = append(batches[m], i)
+	}
+	for m, at := range batches {
+		batch := make([]CustomLink, len(at))
+		for i, j := range at {
+			batch[i] = (*links)[j]
+		}
+		var done []Result
+		err := m.Call("Store.PutMulti", &batch, &done)
+		if err == nil && len(done) != len(batch) {
+			err = errors.New("master answered the wrong number of links")
+		}
+		if err != nil {
+			if s.ring == nil {
+				return remoteError(err)
+			}
+			for i, j := range at {
+				(*rs)[j] = Result{Key: batch[i].Key, Link: batch[i].Link}
+				(*rs)[j].fail(remoteError(err))
+			}
+			continue
+		}
+		for i, r := range done {
+			if r.Err == "" {
+				s.urls.add(r.Key, r.Link)
+			}
+			(*rs)[at[i]] = r
+		}
+	}
+	return nil
+}
+
+// remoteErrors are the errors that remoteError recognizes.
+var remoteErrors = []error{
+	errNotFound, errExpired, errKeyExists, errBadKey, errReserved,
+	errBlocked, errNoNamespace, errNamespaceExists, errNamespaceInUse,
+	errClosed, errBusy, errDegraded, errKeySpace, errBatchSize,
+	errNotLeader, errNoLeader, errUncommitted, errWrongShard, errNotRegistered,
+}
+
+// remoteError maps an error returned by the master back to the local
+// error value with the same text, so callers can compare against it.
+func remoteError(err error) error {
+	if se, ok := err.(rpc.ServerError); ok {
+		for _, e := range remoteErrors {
+			if string(se) == e.Error() {
+				return e
+			}
+		}
+	}
+	return err
+}
+
 func statSend(s string) {
 	if *statServer != "" {
 		stat.In <- s